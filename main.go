@@ -2,7 +2,9 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -22,6 +24,178 @@ type Parcel struct {
 	CreatedAt string
 }
 
+// ParcelStatusView содержит только номер и статус посылки
+type ParcelStatusView struct {
+	Number int
+	Status string
+}
+
+// ClientSummary количество посылок клиента, всего и по статусам
+type ClientSummary struct {
+	Client     int
+	Total      int
+	Registered int
+	Sent       int
+	Delivered  int
+}
+
+// HealthReport сводка о состоянии хранилища. Err содержит текст первой возникшей ошибки
+type HealthReport struct {
+	Reachable    bool
+	IntegrityOK  bool
+	TotalParcels int
+	Err          string
+}
+
+// Операции, которые записываются в журнал изменений
+const (
+	ChangeOpAdd        = "add"
+	ChangeOpSetStatus  = "set_status"
+	ChangeOpSetAddress = "set_address"
+	ChangeOpDelete     = "delete"
+	ChangeOpEdit       = "edit"
+)
+
+// ChangeRecord запись журнала изменений. Seq монотонно возрастает
+type ChangeRecord struct {
+	Seq    int
+	Number int
+	Op     string
+	At     string
+}
+
+// WebhookEvent событие для отправки во внешние вебхуки, построенное по записи журнала изменений.
+// ID совпадает с порядковым номером записи в журнале
+type WebhookEvent struct {
+	ID     int
+	Number int
+	Op     string
+	At     string
+}
+
+// SnapshotCounts количество посылок по статусам на момент At
+type SnapshotCounts struct {
+	At     time.Time
+	Counts map[string]int
+}
+
+// DiffSnapshots возвращает изменение количества посылок каждого статуса от снимка a к снимку b.
+// В результат попадают все статусы, встречающиеся хотя бы в одном из снимков
+func DiffSnapshots(a, b SnapshotCounts) map[string]int {
+	res := make(map[string]int, len(b.Counts))
+	for status, n := range b.Counts {
+		res[status] = n
+	}
+	for status, n := range a.Counts {
+		res[status] -= n
+	}
+
+	return res
+}
+
+// CohortStats сколько посылок недельной когорты создано и сколько из них доставлено
+type CohortStats struct {
+	Created   int
+	Delivered int
+}
+
+// AddressCount количество посылок на адрес
+type AddressCount struct {
+	Address string
+	Count   int
+}
+
+// ParcelFullView посылка вместе с журналом её изменений и заметками
+type ParcelFullView struct {
+	Parcel  Parcel
+	History []ChangeRecord
+	Notes   []Note
+}
+
+// Note заметка службы поддержки о посылке
+type Note struct {
+	ParcelNumber int
+	Note         string
+	At           string
+}
+
+// String возвращает краткое описание посылки для логов.
+// Адрес скрывается, кроме первых двух символов
+func (p Parcel) String() string {
+	addr := []rune(p.Address)
+	if len(addr) > 2 {
+		addr = addr[:2]
+	}
+
+	return fmt.Sprintf("Parcel#%d client=%d status=%s addr=%s*** created=%s",
+		p.Number, p.Client, p.Status, string(addr), p.CreatedAt)
+}
+
+// ErrInvalidParcel возвращается для посылок, которые нельзя сохранить в БД
+var ErrInvalidParcel = errors.New("invalid parcel")
+
+// ValidationResult результат проверки одной посылки из пакета.
+// Index указывает на позицию посылки в пакете, Err равен nil для корректной посылки
+type ValidationResult struct {
+	Index int
+	Err   error
+}
+
+// ValidateBatch проверяет каждую посылку пакета и возвращает результат для каждой из них.
+// Проверка не обращается к БД и не останавливается на первой ошибке
+func ValidateBatch(parcels []Parcel) []ValidationResult {
+	res := make([]ValidationResult, len(parcels))
+	for i, p := range parcels {
+		res[i] = ValidationResult{Index: i, Err: validateParcel(p)}
+	}
+
+	return res
+}
+
+// validateParcel проверяет поля посылки, которые заполняются перед добавлением в БД
+func validateParcel(p Parcel) error {
+	if p.Client <= 0 {
+		return fmt.Errorf("%w: client must be positive", ErrInvalidParcel)
+	}
+
+	if !isKnownStatus(p.Status) {
+		return fmt.Errorf("%w: unknown status %q", ErrInvalidParcel, p.Status)
+	}
+
+	if strings.TrimSpace(p.Address) == "" {
+		return fmt.Errorf("%w: empty address", ErrInvalidParcel)
+	}
+
+	if _, err := time.Parse(time.RFC3339, p.CreatedAt); err != nil {
+		return fmt.Errorf("%w: created at: %v", ErrInvalidParcel, err)
+	}
+
+	return nil
+}
+
+// isKnownStatus сообщает, является ли status одним из статусов посылки
+func isKnownStatus(status string) bool {
+	switch status {
+	case ParcelStatusRegistered, ParcelStatusSent, ParcelStatusDelivered:
+		return true
+	}
+
+	return false
+}
+
+// canTransition сообщает, допустим ли переход посылки из статуса from в статус to:
+// registered -> sent -> delivered
+func canTransition(from, to string) bool {
+	switch from {
+	case ParcelStatusRegistered:
+		return to == ParcelStatusSent
+	case ParcelStatusSent:
+		return to == ParcelStatusDelivered
+	}
+
+	return false
+}
+
 type ParcelService struct {
 	store ParcelStore
 }
@@ -97,9 +271,19 @@ func (s ParcelService) Delete(number int) error {
 }
 
 func main() {
-	// настройте подключение к БД
+	db, err := sql.Open("sqlite", "tracker.db")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer db.Close()
+
+	if err := EnsureSchema(db); err != nil {
+		fmt.Println(err)
+		return
+	}
 
-	store := // создайте объект ParcelStore функцией NewParcelStore
+	store := NewParcelStore(db)
 	service := NewParcelService(store)
 
 	// регистрация посылки
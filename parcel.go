@@ -1,60 +1,3166 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+var (
+	// ErrNoParcels возвращается, когда в таблице parcel нет ни одной посылки
+	ErrNoParcels = errors.New("no parcels")
+	// ErrInvalidRange возвращается, когда начало диапазона больше его конца
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrReadOnly возвращается изменяющими методами, пока хранилище в режиме только для чтения
+	ErrReadOnly = errors.New("parcel store is read-only")
+	// ErrInvalidNumber возвращается для номеров посылок, которых заведомо не может быть в БД
+	ErrInvalidNumber = errors.New("invalid parcel number")
+	// ErrInvalidLimit возвращается, когда ограничение на размер выборки не положительное
+	ErrInvalidLimit = errors.New("invalid limit")
+	// ErrClientLimitExceeded возвращается, когда у клиента уже максимум недоставленных посылок
+	ErrClientLimitExceeded = errors.New("client active parcel limit exceeded")
+	// ErrParcelNotFound возвращается, когда посылки с заданным номером нет в БД
+	ErrParcelNotFound = errors.New("parcel not found")
+	// ErrWrongKey возвращается, когда зашифрованную БД не удалось прочитать с переданным ключом
+	ErrWrongKey = errors.New("wrong database key")
+	// ErrEncryptionUnsupported возвращается, когда драйвер SQLite собран без поддержки шифрования
+	ErrEncryptionUnsupported = errors.New("sqlite driver does not support encryption")
+	// ErrParcelExists возвращается, когда посылка с таким номером уже есть в БД
+	ErrParcelExists = errors.New("parcel already exists")
+	// ErrInvalidStatus возвращается для статусов, которых нет среди статусов посылки
+	ErrInvalidStatus = errors.New("invalid parcel status")
+	// ErrVersionConflict возвращается, когда посылку изменили после того, как её получили для редактирования
+	ErrVersionConflict = errors.New("parcel was modified concurrently")
+	// ErrInvalidTransition возвращается, когда посылку нельзя перевести из текущего статуса в новый
+	ErrInvalidTransition = errors.New("invalid parcel status transition")
+	// ErrAddressNotEditable возвращается при попытке изменить адрес посылки не в статусе registered
+	ErrAddressNotEditable = errors.New("parcel address can only be changed while registered")
+	// ErrRateLimited возвращается, когда клиент превысил допустимую частоту чтения
+	ErrRateLimited = errors.New("client read rate limit exceeded")
+	// ErrDuplicateAddress возвращается, когда у клиента уже есть посылка с таким адресом,
+	// а хранилище требует уникальности адресов в пределах клиента
+	ErrDuplicateAddress = errors.New("client already has a parcel with this address")
+	// ErrInvalidPrefixLength возвращается, когда длина префикса адреса не положительная
+	ErrInvalidPrefixLength = errors.New("invalid address prefix length")
+	// ErrInvalidPollInterval возвращается, когда интервал опроса не положительный
+	ErrInvalidPollInterval = errors.New("invalid poll interval")
+	// ErrInvalidChildCount возвращается, когда количество дочерних посылок не положительное
+	ErrInvalidChildCount = errors.New("invalid number of child parcels")
+)
+
+// Ширина колонок в формате ExportFixedWidth, в символах.
+// Поля выравниваются по левому краю, дополняются пробелами и обрезаются по ширине колонки
+const (
+	FixedWidthNumber  = 8
+	FixedWidthClient  = 10
+	FixedWidthStatus  = 12
+	FixedWidthAddress = 40
+)
+
+// OpenEncryptedDB открывает зашифрованную БД (SQLCipher), применяя ключ через PRAGMA key
+// к каждому новому соединению пула, и проверяет доступ пробным запросом.
+// Драйвер без поддержки шифрования молча игнорирует PRAGMA key и пишет файл открытым текстом,
+// поэтому для такого драйвера возвращается ErrEncryptionUnsupported
+func OpenEncryptedDB(path, key string) (*sql.DB, error) {
+	pragma := "key = " + quoteSQL(key)
+	db, err := sql.Open("sqlite", path+"?_pragma="+url.QueryEscape(pragma))
+	if err != nil {
+		return nil, err
+	}
+
+	// PRAGMA cipher_version возвращает строку только в сборках с SQLCipher
+	var version string
+	err = db.QueryRow("PRAGMA cipher_version").Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		db.Close()
+		return nil, ErrEncryptionUnsupported
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// с неверным ключом первое чтение падает с SQLITE_NOTADB; текст ошибки одинаков во всех драйверах,
+	// а остальные ошибки возвращаются как есть
+	var tables int
+	row := db.QueryRow("SELECT COUNT(*) FROM sqlite_master")
+	if err := row.Scan(&tables); err != nil {
+		db.Close()
+		if strings.Contains(err.Error(), "file is not a database") {
+			return nil, fmt.Errorf("%w: %v", ErrWrongKey, err)
+		}
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// schemaTables создают таблицы хранилища в их текущем виде, если таблиц ещё нет
+var schemaTables = []string{
+	`CREATE TABLE IF NOT EXISTS parcel
+(
+    number           integer
+        constraint parcel_pk
+            primary key autoincrement,
+    client           integer      not null,
+    status           VARCHAR(128) not null,
+    address          VARCHAR(512) not null,
+    created_at       text         not null,
+    address_changed  integer      default 0 not null,
+    parent_number    integer,
+    scheduled_status VARCHAR(128),
+    scheduled_at     text,
+    notified_at      text,
+    delivered_at     text
+)`,
+	`CREATE TABLE IF NOT EXISTS parcel_consumed
+(
+    "group"    VARCHAR(128) not null,
+    number     integer      not null,
+    constraint parcel_consumed_pk
+        primary key ("group", number)
+)`,
+	`CREATE TABLE IF NOT EXISTS parcel_note
+(
+    parcel_number integer not null,
+    note          text    not null,
+    at            text    not null
+)`,
+	`CREATE TABLE IF NOT EXISTS parcel_changelog
+(
+    seq        integer
+        constraint parcel_changelog_pk
+            primary key autoincrement,
+    number     integer     not null,
+    op         VARCHAR(32) not null,
+    at         text        not null,
+    dispatched integer     default 0 not null
+)`,
+}
+
+// schemaColumns колонки, добавленные к таблицам после их первой версии, в порядке добавления.
+// Таблицы, созданные раньше, дополняются ими через ALTER TABLE
+var schemaColumns = []struct {
+	table  string
+	column string
+	ddl    string
+}{
+	{"parcel", "address_changed", "integer default 0 not null"},
+	{"parcel", "parent_number", "integer"},
+	{"parcel", "scheduled_status", "VARCHAR(128)"},
+	{"parcel", "scheduled_at", "text"},
+	{"parcel", "notified_at", "text"},
+	{"parcel", "delivered_at", "text"},
+	{"parcel_changelog", "dispatched", "integer default 0 not null"},
+}
+
+// schemaIndexes создают индексы таблиц хранилища, если их ещё нет
+var schemaIndexes = []string{
+	`CREATE INDEX IF NOT EXISTS parcel_parent_number_index
+    on parcel (parent_number)`,
+	`CREATE INDEX IF NOT EXISTS parcel_scheduled_at_index
+    on parcel (scheduled_at)`,
+	`CREATE INDEX IF NOT EXISTS parcel_note_parcel_number_index
+    on parcel_note (parcel_number)`,
+	`CREATE INDEX IF NOT EXISTS parcel_changelog_dispatched_index
+    on parcel_changelog (dispatched)`,
+}
+
+// EnsureSchema в одной транзакции создаёт недостающие таблицы, колонки и индексы хранилища.
+// Повторный вызов ничего не меняет, поэтому его можно выполнять при каждом запуске
+func EnsureSchema(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, query := range schemaTables {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range schemaColumns {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(:table) WHERE name = :column)",
+			sql.Named("table", c.table),
+			sql.Named("column", c.column)).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		if _, err := tx.Exec("ALTER TABLE " + c.table + " ADD COLUMN " + c.column + " " + c.ddl); err != nil {
+			return fmt.Errorf("add column %s.%s: %w", c.table, c.column, err)
+		}
+	}
+
+	for _, query := range schemaIndexes {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DefaultSummaryTTL время, в течение которого CachedClientSummary возвращает сводку из кэша
+const DefaultSummaryTTL = time.Minute
+
 type ParcelStore struct {
 	db *sql.DB
+	// schema схема БД (например, подключённая через ATTACH), в которой лежат таблицы хранилища.
+	// Пустая строка означает схему по умолчанию
+	schema string
+	// ro, summaries и limiter разделяются между всеми копиями хранилища, созданными из одного NewParcelStore
+	ro        *readOnlyFlag
+	summaries *summaryCache
+	limiter   *readLimiter
+	opts      *storeOptions
+}
+
+type readOnlyFlag struct {
+	mu sync.RWMutex
+	on bool
+}
+
+// storeOptions настройки хранилища, общие для всех его копий
+type storeOptions struct {
+	mu                     sync.RWMutex
+	uniqueAddressPerClient bool
+}
+
+type summaryCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int]cachedSummary
+}
+
+type cachedSummary struct {
+	summary ClientSummary
+	at      time.Time
+}
+
+// readLimiter ограничивает частоту чтения посылок каждого клиента алгоритмом token bucket.
+// Нулевое значение rate отключает ограничение
+type readLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[int]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
 }
 
 func NewParcelStore(db *sql.DB) ParcelStore {
-	return ParcelStore{db: db}
+	return ParcelStore{
+		db: db,
+		ro: &readOnlyFlag{},
+		summaries: &summaryCache{
+			ttl:     DefaultSummaryTTL,
+			entries: map[int]cachedSummary{},
+		},
+		limiter: &readLimiter{
+			buckets: map[int]*tokenBucket{},
+		},
+		opts: &storeOptions{},
+	}
+}
+
+// SetClientReadLimit ограничивает чтение посылок одного клиента частотой rate запросов в секунду
+// с допустимым всплеском до burst запросов. Запросы сверх лимита завершаются ошибкой ErrRateLimited.
+// Ограничение действует в методах, принимающих идентификатор клиента. rate <= 0 отключает его
+func (s *ParcelStore) SetClientReadLimit(rate float64, burst int) {
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+
+	s.limiter.rate = rate
+	s.limiter.burst = burst
+	s.limiter.buckets = map[int]*tokenBucket{}
+}
+
+// allowRead сообщает, можно ли выполнить ещё одно чтение посылок клиента
+func (s ParcelStore) allowRead(client int) bool {
+	if s.limiter == nil {
+		return true
+	}
+
+	s.limiter.mu.Lock()
+	defer s.limiter.mu.Unlock()
+
+	if s.limiter.rate <= 0 {
+		return true
+	}
+
+	now := time.Now()
+	b, ok := s.limiter.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(s.limiter.burst), last: now}
+		s.limiter.buckets[client] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * s.limiter.rate
+	if b.tokens > float64(s.limiter.burst) {
+		b.tokens = float64(s.limiter.burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// identifierRe допустимое имя схемы БД
+var identifierRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// WithSchema возвращает хранилище, работающее с таблицами в схеме schema,
+// например в БД, подключённой через ATTACH DATABASE ... AS schema.
+// Режим только для чтения и настройки общие с исходным хранилищем, кэш сводок клиентов — свой.
+// Паникует, если schema не является допустимым идентификатором
+func (s ParcelStore) WithSchema(schema string) ParcelStore {
+	if !identifierRe.MatchString(schema) {
+		panic(fmt.Sprintf("invalid schema name %q", schema))
+	}
+
+	s.schema = schema
+	if s.summaries == nil {
+		return s
+	}
+
+	s.summaries.mu.Lock()
+	ttl := s.summaries.ttl
+	s.summaries.mu.Unlock()
+
+	s.summaries = &summaryCache{
+		ttl:     ttl,
+		entries: map[int]cachedSummary{},
+	}
+
+	return s
+}
+
+// table возвращает имя таблицы хранилища или служебной таблицы SQLite name, дополненное схемой хранилища.
+// Все запросы хранилища ссылаются на таблицы только через table
+func (s ParcelStore) table(name string) string {
+	if s.schema == "" {
+		return name
+	}
+
+	return s.schema + "." + name
+}
+
+// SetReadOnly включает или выключает режим только для чтения.
+// В этом режиме изменяющие методы сразу возвращают ErrReadOnly, а чтение продолжает работать
+func (s *ParcelStore) SetReadOnly(ro bool) {
+	s.ro.mu.Lock()
+	defer s.ro.mu.Unlock()
+
+	s.ro.on = ro
+}
+
+func (s ParcelStore) isReadOnly() bool {
+	if s.ro == nil {
+		return false
+	}
+
+	s.ro.mu.RLock()
+	defer s.ro.mu.RUnlock()
+
+	return s.ro.on
+}
+
+// SetUniqueAddressPerClient включает или выключает проверку, что у клиента нет двух посылок с одинаковым адресом.
+// Во включённом режиме методы добавления посылок и смены адреса или клиента возвращают ErrDuplicateAddress для повторного адреса,
+// а Split, дочерние посылки которого идут по адресу исходной, — всегда
+func (s *ParcelStore) SetUniqueAddressPerClient(on bool) {
+	s.opts.mu.Lock()
+	defer s.opts.mu.Unlock()
+
+	s.opts.uniqueAddressPerClient = on
+}
+
+func (s ParcelStore) uniqueAddressPerClient() bool {
+	if s.opts == nil {
+		return false
+	}
+
+	s.opts.mu.RLock()
+	defer s.opts.mu.RUnlock()
+
+	return s.opts.uniqueAddressPerClient
 }
 
 func (s ParcelStore) Add(p Parcel) (int, error) {
-	// реализуйте добавление строки в таблицу parcel, используйте данные из переменной p
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := s.insert(tx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.InvalidateClient(p.Client)
+
+	return id, nil
+}
+
+// uniqueAddressGuard возвращает условие для INSERT ... SELECT, которое не даёт добавить клиенту повторный адрес,
+// пока включена уникальность адресов. Запрос передаёт параметры :unique, :client и :address.
+// Проверка и вставка выполняются одним запросом, поэтому параллельные вставки не могут добавить один адрес дважды
+func (s ParcelStore) uniqueAddressGuard() string {
+	return "NOT (:unique AND EXISTS (SELECT 1 FROM " + s.table("parcel") + " WHERE client = :client AND address = :address))"
+}
+
+// uniqueAddressUpdateGuard возвращает условие для UPDATE, которое не даёт сменой адреса или клиента
+// получить у клиента повторный адрес, пока включена уникальность адресов. client — SQL-выражение с клиентом посылки
+// после изменения; запрос передаёт параметры :unique, :address и :number. Сама посылка :number повтором не считается
+func (s ParcelStore) uniqueAddressUpdateGuard(client string) string {
+	return "NOT (:unique AND EXISTS (SELECT 1 FROM " + s.table("parcel") + " AS other WHERE other.client = " + client +
+		" AND other.address = :address AND other.number != :number))"
+}
+
+// addressTaken сообщает, что изменение посылки :number не прошло из-за условия uniqueAddressUpdateGuard(client).
+// Для отсутствующей посылки возвращает false
+func (s ParcelStore) addressTaken(tx *sql.Tx, client string, args ...any) (bool, error) {
+	var taken bool
+	err := tx.QueryRow("SELECT NOT "+s.uniqueAddressUpdateGuard(client)+" FROM "+s.table("parcel")+" WHERE number = :number", args...).Scan(&taken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return taken, err
+}
+
+// insert добавляет посылку в транзакции tx и записывает добавление в журнал изменений
+func (s ParcelStore) insert(tx *sql.Tx, p Parcel) (int, error) {
+	res, err := tx.Exec(`INSERT INTO `+s.table("parcel")+` (client, status, address, created_at)
+		SELECT :client, :status, :address, :created_at
+		WHERE `+s.uniqueAddressGuard(),
+		sql.Named("client", p.Client),
+		sql.Named("status", p.Status),
+		sql.Named("address", p.Address),
+		sql.Named("created_at", p.CreatedAt),
+		sql.Named("unique", s.uniqueAddressPerClient()))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, ErrDuplicateAddress
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.logChange(tx, int(id), ChangeOpAdd); err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+// AddPartialBatch добавляет посылки, для которых известны только клиент и адрес.
+// Статус и время создания заполняются значениями по умолчанию,
+// все вставки выполняются в одной транзакции
+func (s ParcelStore) AddPartialBatch(entries []struct {
+	Client  int
+	Address string
+}) ([]int, error) {
+	if s.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table("parcel") + ` (client, status, address, created_at)
+		SELECT :client, :status, :address, :created_at
+		WHERE ` + s.uniqueAddressGuard())
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	unique := s.uniqueAddressPerClient()
+	ids := make([]int, 0, len(entries))
+	for i, e := range entries {
+		res, err := stmt.Exec(
+			sql.Named("client", e.Client),
+			sql.Named("status", ParcelStatusRegistered),
+			sql.Named("address", e.Address),
+			sql.Named("created_at", createdAt),
+			sql.Named("unique", unique))
+		if err != nil {
+			return nil, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("entry %d: %w", i, ErrDuplicateAddress)
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.logChange(tx, int(id), ChangeOpAdd); err != nil {
+			return nil, err
+		}
+		ids = append(ids, int(id))
+	}
 
-	// верните идентификатор последней добавленной записи
-	return 0, nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		s.InvalidateClient(e.Client)
+	}
+
+	return ids, nil
 }
 
 func (s ParcelStore) Get(number int) (Parcel, error) {
-	// реализуйте чтение строки по заданному number
-	// здесь из таблицы должна вернуться только одна строка
+	if !isValidNumber(number) {
+		return Parcel{}, ErrInvalidNumber
+	}
 
-	// заполните объект Parcel данными из таблицы
 	p := Parcel{}
 
+	row := s.db.QueryRow("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number))
+	err := row.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+	if err != nil {
+		return p, err
+	}
+
 	return p, nil
 }
 
+// isValidNumber сообщает, может ли посылка с таким номером существовать.
+// Номера выдаёт autoincrement, поэтому они всегда положительные
+func isValidNumber(number int) bool {
+	return number > 0
+}
+
 func (s ParcelStore) GetByClient(client int) ([]Parcel, error) {
-	// реализуйте чтение строк из таблицы parcel по заданному client
-	// здесь из таблицы может вернуться несколько строк
+	if !s.allowRead(client) {
+		return nil, ErrRateLimited
+	}
+
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE client = :client",
+		sql.Named("client", client))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// GetByNumberRange возвращает посылки с номерами от from до to включительно, упорядоченные по номеру
+func (s ParcelStore) GetByNumberRange(from, to int) ([]Parcel, error) {
+	if from > to {
+		return nil, ErrInvalidRange
+	}
+
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number BETWEEN :from AND :to ORDER BY number",
+		sql.Named("from", from),
+		sql.Named("to", to))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// scanParcels читает все строки выборки в срез посылок и закрывает rows
+func scanParcels(rows *sql.Rows) ([]Parcel, error) {
+	defer rows.Close()
 
-	// заполните срез Parcel данными из таблицы
 	var res []Parcel
+	for rows.Next() {
+		p := Parcel{}
+		err := rows.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	return res, nil
 }
 
 func (s ParcelStore) SetStatus(number int, status string) error {
-	// реализуйте обновление статуса в таблице parcel
+	if !isValidNumber(number) {
+		return ErrInvalidNumber
+	}
 
-	return nil
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	return s.writeParcel(number, func(tx *sql.Tx) (bool, error) {
+		return s.updateStatus(tx, number, status)
+	})
 }
 
 func (s ParcelStore) SetAddress(number int, address string) error {
-	// реализуйте обновление адреса в таблице parcel
-	// менять адрес можно только если значение статуса registered
+	if !isValidNumber(number) {
+		return ErrInvalidNumber
+	}
 
-	return nil
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	args := []any{
+		sql.Named("address", address),
+		sql.Named("number", number),
+		sql.Named("status", ParcelStatusRegistered),
+		sql.Named("unique", s.uniqueAddressPerClient()),
+	}
+
+	return s.writeParcel(number, func(tx *sql.Tx) (bool, error) {
+		// менять адрес можно только если значение статуса registered
+		// address_changed остаётся установленным, даже если адрес потом вернули к исходному
+		res, err := tx.Exec(`UPDATE `+s.table("parcel")+` SET address = :address, address_changed = (address_changed OR address != :address)
+			WHERE number = :number AND status = :status AND `+s.uniqueAddressUpdateGuard("parcel.client"), args...)
+		if err != nil {
+			return false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			taken, err := s.addressTaken(tx, "parcel.client", args...)
+			if err != nil {
+				return false, err
+			}
+			if taken {
+				return false, ErrDuplicateAddress
+			}
+			return false, nil
+		}
+
+		return true, s.logChange(tx, number, ChangeOpSetAddress)
+	})
 }
 
 func (s ParcelStore) Delete(number int) error {
-	// реализуйте удаление строки из таблицы parcel
+	if !isValidNumber(number) {
+		return ErrInvalidNumber
+	}
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
 	// удалять строку можно только если значение статуса registered
+	return s.execLogged(number, ChangeOpDelete, "DELETE FROM "+s.table("parcel")+" WHERE number = :number AND status = :status",
+		sql.Named("number", number),
+		sql.Named("status", ParcelStatusRegistered))
+}
+
+// execLogged выполняет изменение посылки number и, если оно затронуло строку,
+// записывает его в журнал изменений в той же транзакции
+func (s ParcelStore) execLogged(number int, op string, query string, args ...any) error {
+	return s.writeParcel(number, func(tx *sql.Tx) (bool, error) {
+		res, err := tx.Exec(query, args...)
+		if err != nil {
+			return false, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil || n == 0 {
+			return false, err
+		}
+
+		return true, s.logChange(tx, number, op)
+	})
+}
+
+// writeParcel выполняет изменение посылки number функцией write в транзакции.
+// Если посылка изменилась, после фиксации сбрасывает сводку её клиента в кэше
+func (s ParcelStore) writeParcel(number int, write func(tx *sql.Tx) (bool, error)) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// клиент нужен, чтобы после изменения сбросить его сводку в кэше
+	var client int
+	err = tx.QueryRow("SELECT client FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number)).Scan(&client)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	changed, err := write(tx)
+	if err != nil || !changed {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.InvalidateClient(client)
 
 	return nil
 }
+
+// updateStatus переводит посылку number в статус status в транзакции tx и записывает смену в журнал изменений.
+// Все смены статуса проходят через него: delivered_at проставляется при переходе в delivered
+// и сбрасывается при уходе из него. Возвращает false, если посылки нет или статус у неё уже такой
+func (s ParcelStore) updateStatus(tx *sql.Tx, number int, status string) (bool, error) {
+	// SQLite считает затронутыми все подошедшие строки, поэтому посылку с тем же статусом исключаем,
+	// чтобы в журнал попадали только настоящие смены статуса
+	res, err := tx.Exec(`UPDATE `+s.table("parcel")+` SET status = :status,
+		delivered_at = CASE WHEN :status = :delivered THEN :now END
+		WHERE number = :number AND status != :status`,
+		sql.Named("status", status),
+		sql.Named("delivered", ParcelStatusDelivered),
+		sql.Named("now", time.Now().UTC().Format(time.RFC3339)),
+		sql.Named("number", number))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+
+	return true, s.logChange(tx, number, ChangeOpSetStatus)
+}
+
+// logChange добавляет запись в журнал изменений
+func (s ParcelStore) logChange(tx *sql.Tx, number int, op string) error {
+	_, err := tx.Exec("INSERT INTO "+s.table("parcel_changelog")+" (number, op, at) VALUES (:number, :op, :at)",
+		sql.Named("number", number),
+		sql.Named("op", op),
+		sql.Named("at", time.Now().UTC().Format(time.RFC3339)))
+	return err
+}
+
+// ChangesSince возвращает до limit записей журнала изменений с порядковым номером больше seq
+func (s ParcelStore) ChangesSince(seq int, limit int) ([]ChangeRecord, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+
+	rows, err := s.db.Query("SELECT seq, number, op, at FROM "+s.table("parcel_changelog")+" WHERE seq > :seq ORDER BY seq LIMIT :limit",
+		sql.Named("seq", seq),
+		sql.Named("limit", limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanChanges(rows)
+}
+
+// scanChanges читает все строки выборки в срез записей журнала изменений и закрывает rows
+func scanChanges(rows *sql.Rows) ([]ChangeRecord, error) {
+	defer rows.Close()
+
+	var res []ChangeRecord
+	for rows.Next() {
+		c := ChangeRecord{}
+		if err := rows.Scan(&c.Seq, &c.Number, &c.Op, &c.At); err != nil {
+			return nil, err
+		}
+		res = append(res, c)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// DateSpan возвращает время создания самой ранней и самой поздней посылки
+func (s ParcelStore) DateSpan() (earliest, latest time.Time, err error) {
+	var minCreated, maxCreated sql.NullString
+
+	row := s.db.QueryRow("SELECT MIN(created_at), MAX(created_at) FROM " + s.table("parcel"))
+	err = row.Scan(&minCreated, &maxCreated)
+	if err != nil {
+		return earliest, latest, err
+	}
+
+	// на пустой таблице агрегаты возвращают NULL
+	if !minCreated.Valid || !maxCreated.Valid {
+		return earliest, latest, ErrNoParcels
+	}
+
+	earliest, err = time.Parse(time.RFC3339, minCreated.String)
+	if err != nil {
+		return earliest, latest, err
+	}
+
+	latest, err = time.Parse(time.RFC3339, maxCreated.String)
+	if err != nil {
+		return earliest, latest, err
+	}
+
+	return earliest, latest, nil
+}
+
+// AutoAdvance переводит в статус toStatus посылки со статусом fromStatus,
+// созданные раньше чем age назад, и возвращает количество изменённых посылок
+func (s ParcelStore) AutoAdvance(fromStatus, toStatus string, age time.Duration) (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	// created_at хранится в RFC3339 и UTC, поэтому строки можно сравнивать напрямую
+	cutoff := time.Now().UTC().Add(-age).Format(time.RFC3339)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE status = :from AND created_at < :cutoff ORDER BY number",
+		sql.Named("from", fromStatus),
+		sql.Named("cutoff", cutoff))
+	if err != nil {
+		return 0, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, p := range parcels {
+		ok, err := s.updateStatus(tx, p.Number, toStatus)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			changed++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range parcels {
+		s.InvalidateClient(p.Client)
+	}
+
+	return changed, nil
+}
+
+// ExportFixedWidth записывает в w все посылки в формате с фиксированной шириной колонок,
+// по одной посылке на строку в порядке номеров
+func (s ParcelStore) ExportFixedWidth(w io.Writer) error {
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM " + s.table("parcel") + " ORDER BY number")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p := Parcel{}
+		err := rows.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "%s%s%s%s\n",
+			fixedWidth(fmt.Sprint(p.Number), FixedWidthNumber),
+			fixedWidth(fmt.Sprint(p.Client), FixedWidthClient),
+			fixedWidth(p.Status, FixedWidthStatus),
+			fixedWidth(p.Address, FixedWidthAddress))
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// fixedWidth обрезает или дополняет пробелами value до width символов
+func fixedWidth(value string, width int) string {
+	runes := []rune(value)
+	if len(runes) > width {
+		runes = runes[:width]
+	}
+
+	return fmt.Sprintf("%-*s", width, string(runes))
+}
+
+// PoolStats возвращает статистику пула соединений, которым пользуется хранилище
+func (s ParcelStore) PoolStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+// InUse возвращает количество соединений, занятых в данный момент
+func (s ParcelStore) InUse() int {
+	return s.db.Stats().InUse
+}
+
+// DumpSQL записывает в w скрипт, восстанавливающий таблицу parcel:
+// оператор CREATE TABLE и INSERT со всеми колонками для каждой посылки
+func (s ParcelStore) DumpSQL(w io.Writer) error {
+	var create string
+	row := s.db.QueryRow("SELECT sql FROM " + s.table("sqlite_master") + " WHERE type = 'table' AND name = 'parcel'")
+	if err := row.Scan(&create); err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "%s;\n", create); err != nil {
+		return err
+	}
+
+	rows, err := s.db.Query("SELECT * FROM " + s.table("parcel") + " ORDER BY number")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	literals := make([]string, len(columns))
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		for i, v := range values {
+			literals[i] = sqlLiteral(v)
+		}
+
+		_, err = fmt.Fprintf(w, "INSERT INTO parcel (%s) VALUES (%s);\n",
+			strings.Join(columns, ", "), strings.Join(literals, ", "))
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// sqlLiteral оформляет значение колонки как литерал SQL
+func sqlLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case []byte:
+		return quoteSQL(string(v))
+	default:
+		return quoteSQL(fmt.Sprint(v))
+	}
+}
+
+// quoteSQL оформляет строку как строковый литерал SQL
+func quoteSQL(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// GetFutureDated возвращает посылки, время создания которых позже текущего
+func (s ParcelStore) GetFutureDated() ([]Parcel, error) {
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE created_at > :now ORDER BY number",
+		sql.Named("now", now))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// ClampFutureDates заменяет время создания из будущего на текущее
+// и возвращает количество исправленных посылок
+func (s ParcelStore) ClampFutureDates() (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE created_at > :now ORDER BY number",
+		sql.Named("now", now))
+	if err != nil {
+		return 0, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range parcels {
+		_, err := tx.Exec("UPDATE "+s.table("parcel")+" SET created_at = :now WHERE number = :number",
+			sql.Named("now", now),
+			sql.Named("number", p.Number))
+		if err != nil {
+			return 0, err
+		}
+
+		if err := s.logChange(tx, p.Number, ChangeOpEdit); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return len(parcels), nil
+}
+
+// Funnel возвращает приблизительное количество посылок, достигших каждого этапа доставки.
+// Оценка строится по текущему статусу: этап считается пройденным, если статус посылки не раньше него
+// в цепочке registered -> sent -> delivered. История не учитывается, поэтому посылка, статус которой
+// вернули назад (например, RemapStatuses или импортом), пройденные этапы не засчитывает.
+// Посылки с неизвестными статусами не учитываются
+func (s ParcelStore) Funnel() (registered, sent, delivered int, err error) {
+	row := s.db.QueryRow(`SELECT
+		COUNT(CASE WHEN status IN (:registered, :sent, :delivered) THEN 1 END),
+		COUNT(CASE WHEN status IN (:sent, :delivered) THEN 1 END),
+		COUNT(CASE WHEN status = :delivered THEN 1 END)
+		FROM `+s.table("parcel"),
+		sql.Named("registered", ParcelStatusRegistered),
+		sql.Named("sent", ParcelStatusSent),
+		sql.Named("delivered", ParcelStatusDelivered))
+	err = row.Scan(&registered, &sent, &delivered)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return registered, sent, delivered, nil
+}
+
+// FetchUnconsumed возвращает до limit посылок, которые группа потребителей group ещё не отметила обработанными.
+// Каждая группа отслеживает обработанные посылки независимо от остальных
+func (s ParcelStore) FetchUnconsumed(group string, limit int) ([]Parcel, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+
+	rows, err := s.db.Query(`SELECT number, client, status, address, created_at FROM `+s.table("parcel")+`
+		WHERE number NOT IN (SELECT number FROM `+s.table("parcel_consumed")+` WHERE "group" = :group)
+		ORDER BY number LIMIT :limit`,
+		sql.Named("group", group),
+		sql.Named("limit", limit))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// MarkConsumed отмечает посылки обработанными группой потребителей group
+func (s ParcelStore) MarkConsumed(group string, numbers []int) error {
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO ` + s.table("parcel_consumed") + ` ("group", number) VALUES (:group, :number)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, number := range numbers {
+		_, err := stmt.Exec(
+			sql.Named("group", group),
+			sql.Named("number", number))
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CreationRateByClient возвращает для каждого клиента среднее количество посылок в минуту,
+// созданных за последний window
+func (s ParcelStore) CreationRateByClient(window time.Duration) (map[int]float64, error) {
+	if window <= 0 {
+		return nil, ErrInvalidRange
+	}
+
+	since := time.Now().UTC().Add(-window).Format(time.RFC3339)
+
+	rows, err := s.db.Query("SELECT client, COUNT(*) FROM "+s.table("parcel")+" WHERE created_at >= :since GROUP BY client",
+		sql.Named("since", since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[int]float64{}
+	for rows.Next() {
+		var client, count int
+		if err := rows.Scan(&client, &count); err != nil {
+			return nil, err
+		}
+		res[client] = float64(count) / window.Minutes()
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetByClientSortedByPostal возвращает посылки клиента, упорядоченные по числу в начале адреса.
+// Посылки с адресом без начального числа идут в конце
+func (s ParcelStore) GetByClientSortedByPostal(client int) ([]Parcel, error) {
+	parcels, err := s.GetByClient(client)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(parcels, func(i, j int) bool {
+		a, aok := postalPrefix(parcels[i].Address)
+		b, bok := postalPrefix(parcels[j].Address)
+		if aok != bok {
+			return aok
+		}
+		if a != b {
+			return a < b
+		}
+		return parcels[i].Number < parcels[j].Number
+	})
+
+	return parcels, nil
+}
+
+// postalPrefix возвращает число, с которого начинается адрес
+func postalPrefix(address string) (int, bool) {
+	address = strings.TrimSpace(address)
+
+	end := 0
+	for end < len(address) && address[end] >= '0' && address[end] <= '9' {
+		end++
+	}
+
+	n, err := strconv.Atoi(address[:end])
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// AddIfUnderQuota добавляет посылку, только если у клиента меньше maxActive недоставленных посылок.
+// Подсчёт и вставка выполняются одним оператором INSERT ... SELECT: SQLite берёт блокировку
+// на запись в начале оператора, поэтому параллельные вызовы не могут превысить лимит.
+// Если включена уникальность адресов, повторный адрес клиента отклоняется с ErrDuplicateAddress
+func (s ParcelStore) AddIfUnderQuota(p Parcel, maxActive int) (number int, err error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO `+s.table("parcel")+` (client, status, address, created_at)
+		SELECT :client, :status, :address, :created_at
+		WHERE (SELECT COUNT(*) FROM `+s.table("parcel")+` WHERE client = :client AND status != :delivered) < :max
+		AND `+s.uniqueAddressGuard(),
+		sql.Named("client", p.Client),
+		sql.Named("status", p.Status),
+		sql.Named("address", p.Address),
+		sql.Named("created_at", p.CreatedAt),
+		sql.Named("delivered", ParcelStatusDelivered),
+		sql.Named("max", maxActive),
+		sql.Named("unique", s.uniqueAddressPerClient()))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		// вставку могло остановить любое из двух условий, выясняем какое
+		var unique bool
+		err := tx.QueryRow("SELECT "+s.uniqueAddressGuard(),
+			sql.Named("client", p.Client),
+			sql.Named("address", p.Address),
+			sql.Named("unique", s.uniqueAddressPerClient())).Scan(&unique)
+		if err != nil {
+			return 0, err
+		}
+		if !unique {
+			return 0, ErrDuplicateAddress
+		}
+		return 0, ErrClientLimitExceeded
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := s.logChange(tx, int(id), ChangeOpAdd); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.InvalidateClient(p.Client)
+
+	return int(id), nil
+}
+
+// GetByStatuses возвращает посылки, статус которых совпадает с любым из statuses
+func (s ParcelStore) GetByStatuses(statuses []string) ([]Parcel, error) {
+	if len(statuses) == 0 {
+		return []Parcel{}, nil
+	}
+
+	list, args := inList("status", statuses)
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE status IN ("+list+") ORDER BY number",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// inList возвращает список именованных параметров name0, name1, ... для оператора IN
+// и соответствующие им аргументы запроса
+func inList[T any](name string, values []T) (string, []any) {
+	placeholders := make([]string, len(values))
+	args := make([]any, len(values))
+	for i, v := range values {
+		param := fmt.Sprintf("%s%d", name, i)
+		placeholders[i] = ":" + param
+		args[i] = sql.Named(param, v)
+	}
+
+	return strings.Join(placeholders, ", "), args
+}
+
+// WaitForStatus опрашивает БД с интервалом poll, пока статус посылки не станет равен target
+// или не будет отменён ctx. Если посылка пропала из БД, возвращает ErrParcelNotFound
+func (s ParcelStore) WaitForStatus(ctx context.Context, number int, target string, poll time.Duration) error {
+	if poll <= 0 {
+		return ErrInvalidPollInterval
+	}
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		p, err := s.Get(number)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrParcelNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if p.Status == target {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// CreationByWeekday возвращает количество созданных посылок по дням недели
+func (s ParcelStore) CreationByWeekday() (map[time.Weekday]int, error) {
+	rows, err := s.db.Query("SELECT created_at FROM " + s.table("parcel"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[time.Weekday]int{}
+	for rows.Next() {
+		var createdAt string
+		if err := rows.Scan(&createdAt); err != nil {
+			return nil, err
+		}
+
+		created, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		res[created.Weekday()]++
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// AddNote добавляет заметку к посылке. Если посылки нет, возвращает ErrParcelNotFound
+func (s ParcelStore) AddNote(number int, note string) error {
+	if !isValidNumber(number) {
+		return ErrInvalidNumber
+	}
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	row := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM "+s.table("parcel")+" WHERE number = :number)",
+		sql.Named("number", number))
+	if err := row.Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrParcelNotFound
+	}
+
+	_, err = tx.Exec("INSERT INTO "+s.table("parcel_note")+" (parcel_number, note, at) VALUES (:number, :note, :at)",
+		sql.Named("number", number),
+		sql.Named("note", note),
+		sql.Named("at", time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetNotes возвращает заметки посылки в порядке добавления
+func (s ParcelStore) GetNotes(number int) ([]Note, error) {
+	rows, err := s.db.Query("SELECT parcel_number, note, at FROM "+s.table("parcel_note")+" WHERE parcel_number = :number ORDER BY at, rowid",
+		sql.Named("number", number))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanNotes(rows)
+}
+
+// scanNotes читает все строки выборки в срез заметок и закрывает rows
+func scanNotes(rows *sql.Rows) ([]Note, error) {
+	defer rows.Close()
+
+	var res []Note
+	for rows.Next() {
+		n := Note{}
+		if err := rows.Scan(&n.ParcelNumber, &n.Note, &n.At); err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// StatusViewByClient возвращает номера и статусы посылок клиента без остальных полей
+func (s ParcelStore) StatusViewByClient(client int) ([]ParcelStatusView, error) {
+	if !s.allowRead(client) {
+		return nil, ErrRateLimited
+	}
+
+	rows, err := s.db.Query("SELECT number, status FROM "+s.table("parcel")+" WHERE client = :client ORDER BY number",
+		sql.Named("client", client))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []ParcelStatusView
+	for rows.Next() {
+		v := ParcelStatusView{}
+		if err := rows.Scan(&v.Number, &v.Status); err != nil {
+			return nil, err
+		}
+		res = append(res, v)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// GetAddressChanged возвращает посылки, адрес которых меняли после создания
+func (s ParcelStore) GetAddressChanged() ([]Parcel, error) {
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM " + s.table("parcel") + " WHERE address_changed ORDER BY number")
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// SetSummaryTTL задаёт время жизни сводок клиентов в кэше CachedClientSummary
+func (s *ParcelStore) SetSummaryTTL(ttl time.Duration) {
+	s.summaries.mu.Lock()
+	defer s.summaries.mu.Unlock()
+
+	s.summaries.ttl = ttl
+}
+
+// CachedClientSummary возвращает сводку по посылкам клиента.
+// Сводка пересчитывается, только если её нет в кэше или она старше заданного времени жизни.
+// У хранилища, созданного не через NewParcelStore, кэша нет и сводка считается при каждом вызове
+func (s ParcelStore) CachedClientSummary(client int) (ClientSummary, error) {
+	if !s.allowRead(client) {
+		return ClientSummary{}, ErrRateLimited
+	}
+
+	if s.summaries == nil {
+		return s.clientSummary(client)
+	}
+
+	s.summaries.mu.Lock()
+	entry, ok := s.summaries.entries[client]
+	fresh := ok && time.Since(entry.at) < s.summaries.ttl
+	s.summaries.mu.Unlock()
+
+	if fresh {
+		return entry.summary, nil
+	}
+
+	summary, err := s.clientSummary(client)
+	if err != nil {
+		return summary, err
+	}
+
+	s.summaries.mu.Lock()
+	s.summaries.entries[client] = cachedSummary{summary: summary, at: time.Now()}
+	s.summaries.mu.Unlock()
+
+	return summary, nil
+}
+
+// InvalidateClient удаляет сводку клиента из кэша.
+// Изменяющие методы хранилища вызывают её сами, вызывать её нужно после изменения посылок в обход хранилища
+func (s ParcelStore) InvalidateClient(client int) {
+	if s.summaries == nil {
+		return
+	}
+
+	s.summaries.mu.Lock()
+	defer s.summaries.mu.Unlock()
+
+	delete(s.summaries.entries, client)
+}
+
+// invalidateAllClients удаляет из кэша сводки всех клиентов
+func (s ParcelStore) invalidateAllClients() {
+	if s.summaries == nil {
+		return
+	}
+
+	s.summaries.mu.Lock()
+	defer s.summaries.mu.Unlock()
+
+	clear(s.summaries.entries)
+}
+
+// clientSummary подсчитывает посылки клиента по статусам
+func (s ParcelStore) clientSummary(client int) (ClientSummary, error) {
+	summary := ClientSummary{Client: client}
+
+	row := s.db.QueryRow(`SELECT
+		COUNT(*),
+		COUNT(CASE WHEN status = :registered THEN 1 END),
+		COUNT(CASE WHEN status = :sent THEN 1 END),
+		COUNT(CASE WHEN status = :delivered THEN 1 END)
+		FROM `+s.table("parcel")+` WHERE client = :client`,
+		sql.Named("registered", ParcelStatusRegistered),
+		sql.Named("sent", ParcelStatusSent),
+		sql.Named("delivered", ParcelStatusDelivered),
+		sql.Named("client", client))
+	err := row.Scan(&summary.Total, &summary.Registered, &summary.Sent, &summary.Delivered)
+	if err != nil {
+		return summary, err
+	}
+
+	return summary, nil
+}
+
+// ConflictMode определяет, что делает ImportSlice с посылкой, номер которой уже занят
+type ConflictMode int
+
+const (
+	// ConflictError прерывает импорт с ошибкой ErrParcelExists
+	ConflictError ConflictMode = iota
+	// ConflictSkip оставляет существующую посылку без изменений
+	ConflictSkip
+	// ConflictReplace заменяет существующую посылку импортируемой
+	ConflictReplace
+)
+
+// ImportResult количество посылок, добавленных, пропущенных и заменённых при импорте
+type ImportResult struct {
+	Inserted int
+	Skipped  int
+	Replaced int
+}
+
+// ImportSlice импортирует посылки в одной транзакции.
+// Посылки без номера получают новый номер, для остальных номер сохраняется,
+// а конфликт с существующей посылкой разрешается согласно mode
+func (s ParcelStore) ImportSlice(parcels []Parcel, mode ConflictMode) (ImportResult, error) {
+	res := ImportResult{}
+
+	if s.isReadOnly() {
+		return res, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	for _, p := range parcels {
+		exists := false
+		var oldStatus string
+		if p.Number != 0 {
+			row := tx.QueryRow("SELECT status FROM "+s.table("parcel")+" WHERE number = :number",
+				sql.Named("number", p.Number))
+			err := row.Scan(&oldStatus)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return ImportResult{}, err
+			}
+			exists = err == nil
+		}
+
+		insert := "INSERT"
+		if exists {
+			switch mode {
+			case ConflictSkip:
+				res.Skipped++
+				continue
+			case ConflictReplace:
+				insert = "INSERT OR REPLACE"
+			default:
+				return ImportResult{}, fmt.Errorf("parcel %d: %w", p.Number, ErrParcelExists)
+			}
+		}
+
+		// заменяемая посылка сама не считается повтором адреса
+		query := insert + ` INTO ` + s.table("parcel") + ` (number, client, status, address, created_at)
+			SELECT :number, :client, :status, :address, :created_at
+			WHERE NOT (:unique AND EXISTS (SELECT 1 FROM ` + s.table("parcel") + ` WHERE client = :client AND address = :address AND number IS NOT :number))`
+
+		// для нулевого номера передаём NULL, чтобы номер выдал autoincrement
+		var number any
+		if p.Number != 0 {
+			number = p.Number
+		}
+
+		r, err := tx.Exec(query,
+			sql.Named("number", number),
+			sql.Named("client", p.Client),
+			sql.Named("status", p.Status),
+			sql.Named("address", p.Address),
+			sql.Named("created_at", p.CreatedAt),
+			sql.Named("unique", s.uniqueAddressPerClient()))
+		if err != nil {
+			return ImportResult{}, err
+		}
+
+		n, err := r.RowsAffected()
+		if err != nil {
+			return ImportResult{}, err
+		}
+		if n == 0 {
+			return ImportResult{}, fmt.Errorf("parcel %d: %w", p.Number, ErrDuplicateAddress)
+		}
+
+		id, err := r.LastInsertId()
+		if err != nil {
+			return ImportResult{}, err
+		}
+
+		// замена существующей посылки записывается в журнал как её редактирование,
+		// а смена статуса при замене — отдельной записью
+		op := ChangeOpAdd
+		if exists {
+			op = ChangeOpEdit
+		}
+		if err := s.logChange(tx, int(id), op); err != nil {
+			return ImportResult{}, err
+		}
+		if exists && p.Status != oldStatus {
+			if err := s.logChange(tx, int(id), ChangeOpSetStatus); err != nil {
+				return ImportResult{}, err
+			}
+		}
+
+		if exists {
+			res.Replaced++
+		} else {
+			res.Inserted++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ImportResult{}, err
+	}
+
+	// заменённая посылка могла принадлежать другому клиенту, поэтому кэш сбрасывается целиком
+	s.invalidateAllClients()
+
+	return res, nil
+}
+
+// AverageParcelsPerClient возвращает среднее количество посылок на одного клиента
+func (s ParcelStore) AverageParcelsPerClient() (float64, error) {
+	var avg float64
+
+	// на пустой таблице деление на ноль в SQLite даёт NULL
+	row := s.db.QueryRow("SELECT IFNULL(CAST(COUNT(*) AS REAL) / COUNT(DISTINCT client), 0) FROM " + s.table("parcel"))
+	if err := row.Scan(&avg); err != nil {
+		return 0, err
+	}
+
+	return avg, nil
+}
+
+// Health проверяет доступность БД, её целостность и подсчитывает посылки.
+// Ошибки не возвращаются, а записываются в отчёт
+func (s ParcelStore) Health(ctx context.Context) HealthReport {
+	report := HealthReport{}
+
+	if err := s.db.PingContext(ctx); err != nil {
+		report.Err = err.Error()
+		return report
+	}
+	report.Reachable = true
+
+	var integrity string
+	row := s.db.QueryRowContext(ctx, "PRAGMA integrity_check")
+	if err := row.Scan(&integrity); err != nil {
+		report.Err = err.Error()
+		return report
+	}
+	if integrity != "ok" {
+		report.Err = integrity
+		return report
+	}
+	report.IntegrityOK = true
+
+	row = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+s.table("parcel"))
+	if err := row.Scan(&report.TotalParcels); err != nil {
+		report.Err = err.Error()
+		return report
+	}
+
+	return report
+}
+
+// Split создаёт n дочерних посылок с клиентом и адресом посылки number
+// и возвращает их номера. Дочерние посылки ссылаются на исходную через parent_number
+func (s ParcelStore) Split(number, n int) ([]int, error) {
+	if !isValidNumber(number) {
+		return nil, ErrInvalidNumber
+	}
+
+	if n <= 0 {
+		return nil, ErrInvalidChildCount
+	}
+
+	if s.isReadOnly() {
+		return nil, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	parent := Parcel{}
+	row := tx.QueryRow("SELECT client, address FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number))
+	err = row.Scan(&parent.Client, &parent.Address)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrParcelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// дочерние посылки идут по адресу исходной, поэтому при уникальности адресов Split невозможен
+	if s.uniqueAddressPerClient() {
+		return nil, ErrDuplicateAddress
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table("parcel") + ` (client, status, address, created_at, parent_number)
+		VALUES (:client, :status, :address, :created_at, :parent)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	createdAt := time.Now().UTC().Format(time.RFC3339)
+	ids := make([]int, 0, n)
+	for i := 0; i < n; i++ {
+		res, err := stmt.Exec(
+			sql.Named("client", parent.Client),
+			sql.Named("status", ParcelStatusRegistered),
+			sql.Named("address", parent.Address),
+			sql.Named("created_at", createdAt),
+			sql.Named("parent", number))
+		if err != nil {
+			return nil, err
+		}
+
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := s.logChange(tx, int(id), ChangeOpAdd); err != nil {
+			return nil, err
+		}
+		ids = append(ids, int(id))
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.InvalidateClient(parent.Client)
+
+	return ids, nil
+}
+
+// Children возвращает дочерние посылки, созданные из посылки number
+func (s ParcelStore) Children(number int) ([]Parcel, error) {
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE parent_number = :number ORDER BY number",
+		sql.Named("number", number))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// ClientDiff сравнивает посылки двух клиентов по адресу и возвращает посылки,
+// адресов которых нет среди посылок другого клиента
+func (s ParcelStore) ClientDiff(a, b int) (onlyA, onlyB []Parcel, err error) {
+	parcelsA, err := s.GetByClient(a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parcelsB, err := s.GetByClient(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return missingAddresses(parcelsA, parcelsB), missingAddresses(parcelsB, parcelsA), nil
+}
+
+// missingAddresses возвращает посылки из parcels, адресов которых нет в other
+func missingAddresses(parcels, other []Parcel) []Parcel {
+	addresses := make(map[string]struct{}, len(other))
+	for _, p := range other {
+		addresses[p.Address] = struct{}{}
+	}
+
+	var res []Parcel
+	for _, p := range parcels {
+		if _, ok := addresses[p.Address]; !ok {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+// WeeklyCohorts группирует посылки по ISO-неделе создания, например "2024-W03",
+// и для каждой недели считает созданные и доставленные посылки
+func (s ParcelStore) WeeklyCohorts() (map[string]CohortStats, error) {
+	rows, err := s.db.Query("SELECT status, created_at FROM " + s.table("parcel"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[string]CohortStats{}
+	for rows.Next() {
+		var status, createdAt string
+		if err := rows.Scan(&status, &createdAt); err != nil {
+			return nil, err
+		}
+
+		created, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, err
+		}
+
+		year, week := created.ISOWeek()
+		key := fmt.Sprintf("%04d-W%02d", year, week)
+
+		stats := res[key]
+		stats.Created++
+		if status == ParcelStatusDelivered {
+			stats.Delivered++
+		}
+		res[key] = stats
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// MoveTo переносит посылку number в хранилище dst и возвращает её номер в dst.
+// Переносится только строка parcel, заметки и прочие связанные данные остаются в исходной БД.
+//
+// Если оба хранилища работают через один *sql.DB (например, dst получено через WithSchema),
+// перенос выполняется одной транзакцией.
+// Иначе две БД нельзя изменить одной транзакцией, поэтому перенос выполняется в два шага:
+// посылка добавляется в dst, а затем удаляется из исходной БД в транзакции,
+// открытой до вставки. Если вставка не удалась, исходная посылка не меняется.
+// Если не удалось удалить исходную посылку, добавленная в dst удаляется обратно.
+// Между шагами посылка на короткое время видна в обеих БД
+func (s ParcelStore) MoveTo(number int, dst ParcelStore) (int, error) {
+	if !isValidNumber(number) {
+		return 0, ErrInvalidNumber
+	}
+
+	if s.isReadOnly() || dst.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	p := Parcel{}
+	row := tx.QueryRow("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number))
+	err = row.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrParcelNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	deleteAndCommit := func() error {
+		_, err := tx.Exec("DELETE FROM "+s.table("parcel")+" WHERE number = :number",
+			sql.Named("number", number))
+		if err != nil {
+			return err
+		}
+
+		if err := s.logChange(tx, number, ChangeOpDelete); err != nil {
+			return err
+		}
+
+		return tx.Commit()
+	}
+
+	// отдельная вставка через dst.Add ждала бы соединение, занятое tx,
+	// и при SetMaxOpenConns(1), который нужен для ATTACH, никогда бы его не получила
+	if s.db == dst.db {
+		id, err := dst.insert(tx, p)
+		if err != nil {
+			return 0, err
+		}
+
+		if err := deleteAndCommit(); err != nil {
+			return 0, err
+		}
+
+		s.InvalidateClient(p.Client)
+		dst.InvalidateClient(p.Client)
+
+		return id, nil
+	}
+
+	id, err := dst.Add(p)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := deleteAndCommit(); err != nil {
+		// компенсируем вставку, чтобы посылка не осталась в обеих БД
+		_, cerr := dst.db.Exec("DELETE FROM "+dst.table("parcel")+" WHERE number = :number",
+			sql.Named("number", id))
+		if cerr != nil {
+			return 0, fmt.Errorf("%w (compensation failed: %v)", err, cerr)
+		}
+		return 0, err
+	}
+
+	s.InvalidateClient(p.Client)
+
+	return id, nil
+}
+
+// DumpOrdered возвращает все посылки, упорядоченные по номеру.
+// Для пустой таблицы возвращается пустой, а не nil срез, чтобы результат сериализовался одинаково
+func (s ParcelStore) DumpOrdered() ([]Parcel, error) {
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM " + s.table("parcel") + " ORDER BY number")
+	if err != nil {
+		return nil, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return nil, err
+	}
+	if parcels == nil {
+		parcels = []Parcel{}
+	}
+
+	return parcels, nil
+}
+
+// ScheduleStatus планирует смену статуса посылки на момент at.
+// Запланированные статусы применяет ApplyDueSchedules, новая запись заменяет прежнюю
+func (s ParcelStore) ScheduleStatus(number int, status string, at time.Time) error {
+	if !isValidNumber(number) {
+		return ErrInvalidNumber
+	}
+
+	if !isKnownStatus(status) {
+		return ErrInvalidStatus
+	}
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	res, err := s.db.Exec("UPDATE "+s.table("parcel")+" SET scheduled_status = :status, scheduled_at = :at WHERE number = :number",
+		sql.Named("status", status),
+		sql.Named("at", at.UTC().Format(time.RFC3339)),
+		sql.Named("number", number))
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrParcelNotFound
+	}
+
+	return nil
+}
+
+// ApplyDueSchedules применяет запланированные статусы, время которых не позже now,
+// записывает смену статуса в журнал изменений и возвращает количество изменённых посылок
+func (s ParcelStore) ApplyDueSchedules(now time.Time) (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT number, client, scheduled_status FROM "+s.table("parcel")+" WHERE scheduled_at <= :now ORDER BY scheduled_at, number",
+		sql.Named("now", now.UTC().Format(time.RFC3339)))
+	if err != nil {
+		return 0, err
+	}
+
+	var due []Parcel
+	for rows.Next() {
+		p := Parcel{}
+		if err := rows.Scan(&p.Number, &p.Client, &p.Status); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range due {
+		if _, err := s.updateStatus(tx, p.Number, p.Status); err != nil {
+			return 0, err
+		}
+
+		_, err := tx.Exec("UPDATE "+s.table("parcel")+" SET scheduled_status = NULL, scheduled_at = NULL WHERE number = :number",
+			sql.Named("number", p.Number))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range due {
+		s.InvalidateClient(p.Client)
+	}
+
+	return len(due), nil
+}
+
+// TopAddresses возвращает n адресов с наибольшим количеством посылок.
+// При равном количестве адреса упорядочиваются по алфавиту
+func (s ParcelStore) TopAddresses(n int) ([]AddressCount, error) {
+	if n <= 0 {
+		return nil, ErrInvalidLimit
+	}
+
+	rows, err := s.db.Query("SELECT address, COUNT(*) AS cnt FROM "+s.table("parcel")+" GROUP BY address ORDER BY cnt DESC, address LIMIT :limit",
+		sql.Named("limit", n))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []AddressCount
+	for rows.Next() {
+		a := AddressCount{}
+		if err := rows.Scan(&a.Address, &a.Count); err != nil {
+			return nil, err
+		}
+		res = append(res, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// FullView возвращает посылку вместе с её журналом изменений и заметками.
+// Все данные читаются в одной транзакции и поэтому согласованы между собой
+func (s ParcelStore) FullView(number int) (ParcelFullView, error) {
+	if !isValidNumber(number) {
+		return ParcelFullView{}, ErrInvalidNumber
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ParcelFullView{}, err
+	}
+	defer tx.Rollback()
+
+	view, err := s.readFullView(tx, number)
+	if err != nil {
+		return view, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return ParcelFullView{}, err
+	}
+
+	return view, nil
+}
+
+// readFullView читает посылку, её журнал изменений и заметки в транзакции tx
+func (s ParcelStore) readFullView(tx *sql.Tx, number int) (ParcelFullView, error) {
+	view := ParcelFullView{}
+
+	p := Parcel{}
+	row := tx.QueryRow("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number))
+	err := row.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return view, ErrParcelNotFound
+	}
+	if err != nil {
+		return view, err
+	}
+
+	rows, err := tx.Query("SELECT seq, number, op, at FROM "+s.table("parcel_changelog")+" WHERE number = :number ORDER BY seq",
+		sql.Named("number", number))
+	if err != nil {
+		return view, err
+	}
+	history, err := scanChanges(rows)
+	if err != nil {
+		return view, err
+	}
+
+	rows, err = tx.Query("SELECT parcel_number, note, at FROM "+s.table("parcel_note")+" WHERE parcel_number = :number ORDER BY at, rowid",
+		sql.Named("number", number))
+	if err != nil {
+		return view, err
+	}
+	notes, err := scanNotes(rows)
+	if err != nil {
+		return view, err
+	}
+
+	view.Parcel = p
+	view.History = history
+	view.Notes = notes
+
+	return view, nil
+}
+
+// NormalizeAllAddresses приводит адреса всех посылок к нормализованному виду
+// и возвращает количество изменённых посылок. Посылки с уже нормализованным адресом не обновляются
+func (s ParcelStore) NormalizeAllAddresses() (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT number, client, status, address, created_at FROM " + s.table("parcel") + " ORDER BY number")
+	if err != nil {
+		return 0, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, p := range parcels {
+		normalized := normalizeAddress(p.Address)
+		if normalized == p.Address {
+			continue
+		}
+
+		res, err := tx.Exec("UPDATE "+s.table("parcel")+" SET address = :address WHERE number = :number AND "+s.uniqueAddressUpdateGuard(":client"),
+			sql.Named("address", normalized),
+			sql.Named("number", p.Number),
+			sql.Named("client", p.Client),
+			sql.Named("unique", s.uniqueAddressPerClient()))
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			return 0, fmt.Errorf("parcel %d: %w", p.Number, ErrDuplicateAddress)
+		}
+
+		if err := s.logChange(tx, p.Number, ChangeOpSetAddress); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return changed, nil
+}
+
+// normalizeAddress убирает пробелы в начале и конце адреса
+// и заменяет последовательности пробельных символов внутри него одним пробелом
+func normalizeAddress(address string) string {
+	return strings.Join(strings.Fields(address), " ")
+}
+
+// GetPendingNotifications возвращает посылки в статусе status, о которых ещё не отправлено уведомление
+func (s ParcelStore) GetPendingNotifications(status string) ([]Parcel, error) {
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE status = :status AND notified_at IS NULL ORDER BY number",
+		sql.Named("status", status))
+	if err != nil {
+		return nil, err
+	}
+
+	return scanParcels(rows)
+}
+
+// MarkNotified отмечает, что уведомления о посылках отправлены,
+// и возвращает количество посылок, отмеченных этим вызовом
+func (s ParcelStore) MarkNotified(numbers []int) (int, error) {
+	if len(numbers) == 0 {
+		return 0, nil
+	}
+
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	list, args := inList("number", numbers)
+	args = append(args, sql.Named("now", time.Now().UTC().Format(time.RFC3339)))
+
+	res, err := s.db.Exec("UPDATE "+s.table("parcel")+" SET notified_at = :now WHERE notified_at IS NULL AND number IN ("+list+")",
+		args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// prometheusLabelEscaper экранирует значение метки по правилам текстового формата Prometheus:
+// экранируются только обратная косая черта, двойная кавычка и перевод строки
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus записывает в w количество посылок, всего и по статусам,
+// в текстовом формате метрик Prometheus
+func (s ParcelStore) WritePrometheus(w io.Writer) error {
+	rows, err := s.db.Query("SELECT status, COUNT(*) FROM " + s.table("parcel") + " GROUP BY status")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	byStatus := map[string]int{
+		ParcelStatusRegistered: 0,
+		ParcelStatusSent:       0,
+		ParcelStatusDelivered:  0,
+	}
+	total := 0
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return err
+		}
+		byStatus[status] = count
+		total += count
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	statuses := make([]string, 0, len(byStatus))
+	for status := range byStatus {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	var b strings.Builder
+	b.WriteString("# HELP parcels_total Total number of parcels.\n")
+	b.WriteString("# TYPE parcels_total gauge\n")
+	fmt.Fprintf(&b, "parcels_total %d\n", total)
+	b.WriteString("# HELP parcels_by_status Number of parcels by status.\n")
+	b.WriteString("# TYPE parcels_by_status gauge\n")
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "parcels_by_status{status=\"%s\"} %d\n", prometheusLabelEscaper.Replace(status), byStatus[status])
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// GetForEdit возвращает посылку и токен её текущего состояния для последующего SaveEdit
+func (s ParcelStore) GetForEdit(number int) (Parcel, string, error) {
+	p, err := s.Get(number)
+	if errors.Is(err, sql.ErrNoRows) {
+		return p, "", ErrParcelNotFound
+	}
+	if err != nil {
+		return p, "", err
+	}
+
+	return p, editToken(p), nil
+}
+
+// SaveEdit сохраняет клиента, статус и адрес посылки, если с момента GetForEdit
+// посылка не менялась, иначе возвращает ErrVersionConflict.
+// Статус можно оставить прежним или перевести на следующий, адрес — менять только у посылки в статусе registered
+func (s ParcelStore) SaveEdit(p Parcel, token string) error {
+	if !isValidNumber(p.Number) {
+		return ErrInvalidNumber
+	}
+
+	if !isKnownStatus(p.Status) {
+		return fmt.Errorf("%w: %q", ErrInvalidStatus, p.Status)
+	}
+
+	if s.isReadOnly() {
+		return ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current := Parcel{}
+	row := tx.QueryRow("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", p.Number))
+	err = row.Scan(&current.Number, &current.Client, &current.Status, &current.Address, &current.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrParcelNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if editToken(current) != token {
+		return ErrVersionConflict
+	}
+
+	if p.Status != current.Status && !canTransition(current.Status, p.Status) {
+		return fmt.Errorf("%w: %s -> %s", ErrInvalidTransition, current.Status, p.Status)
+	}
+
+	if p.Address != current.Address && current.Status != ParcelStatusRegistered {
+		return ErrAddressNotEditable
+	}
+
+	// смена статуса записывается отдельно, чтобы её учитывала статистика смен статусов
+	if _, err := s.updateStatus(tx, p.Number, p.Status); err != nil {
+		return err
+	}
+
+	if p.Client != current.Client || p.Address != current.Address {
+		res, err := tx.Exec(`UPDATE `+s.table("parcel")+` SET client = :client, address = :address,
+			address_changed = (address_changed OR address != :address)
+			WHERE number = :number AND `+s.uniqueAddressUpdateGuard(":client"),
+			sql.Named("client", p.Client),
+			sql.Named("address", p.Address),
+			sql.Named("number", p.Number),
+			sql.Named("unique", s.uniqueAddressPerClient()))
+		if err != nil {
+			return err
+		}
+
+		// посылка прочитана в этой же транзакции, поэтому не обновиться она могла только из-за повтора адреса
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return ErrDuplicateAddress
+		}
+
+		if err := s.logChange(tx, p.Number, ChangeOpEdit); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.InvalidateClient(current.Client)
+	s.InvalidateClient(p.Client)
+
+	return nil
+}
+
+// editToken возвращает хэш изменяемых полей посылки
+func editToken(p Parcel) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\x00%d\x00%s\x00%s", p.Number, p.Client, p.Status, p.Address)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Iter возвращает итератор по всем посылкам в порядке номеров.
+// Посылки читаются из БД по одной, ошибка передаётся вторым значением и завершает итерацию.
+// Выборка закрывается, когда итерация закончена или прервана
+func (s ParcelStore) Iter(ctx context.Context) iter.Seq2[Parcel, error] {
+	return func(yield func(Parcel, error) bool) {
+		rows, err := s.db.QueryContext(ctx, "SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" ORDER BY number")
+		if err != nil {
+			yield(Parcel{}, err)
+			return
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			p := Parcel{}
+			if err := rows.Scan(&p.Number, &p.Client, &p.Status, &p.Address, &p.CreatedAt); err != nil {
+				yield(Parcel{}, err)
+				return
+			}
+
+			if !yield(p, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(Parcel{}, err)
+		}
+	}
+}
+
+// CreationByHour возвращает количество созданных посылок по часам суток (0–23) в UTC
+func (s ParcelStore) CreationByHour() (map[int]int, error) {
+	return s.CreationByHourIn(time.UTC)
+}
+
+// CreationByHourIn возвращает количество созданных посылок по часам суток (0–23) в часовом поясе loc.
+// Если loc равен nil, используется UTC
+func (s ParcelStore) CreationByHourIn(loc *time.Location) (map[int]int, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	rows, err := s.db.Query("SELECT created_at FROM " + s.table("parcel"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := map[int]int{}
+	for rows.Next() {
+		var createdAt string
+		if err := rows.Scan(&createdAt); err != nil {
+			return nil, err
+		}
+
+		created, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return nil, err
+		}
+		res[created.In(loc).Hour()]++
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// RemapStatuses заменяет статусы посылок по таблице mapping (старый статус -> новый)
+// и возвращает количество изменённых посылок. Все замены применяются одновременно,
+// поэтому цепочки вида a -> b, b -> c не переводят a в c
+func (s ParcelStore) RemapStatuses(mapping map[string]string) (int, error) {
+	for _, to := range mapping {
+		if !isKnownStatus(to) {
+			return 0, fmt.Errorf("%w: %q", ErrInvalidStatus, to)
+		}
+	}
+
+	if len(mapping) == 0 {
+		return 0, nil
+	}
+
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	from := make([]string, 0, len(mapping))
+	for status := range mapping {
+		from = append(from, status)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	list, args := inList("status", from)
+	rows, err := tx.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE status IN ("+list+") ORDER BY number",
+		args...)
+	if err != nil {
+		return 0, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, p := range parcels {
+		to := mapping[p.Status]
+		if to == p.Status {
+			continue
+		}
+
+		if _, err := s.updateStatus(tx, p.Number, to); err != nil {
+			return 0, err
+		}
+		changed++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	for _, p := range parcels {
+		s.InvalidateClient(p.Client)
+	}
+
+	return changed, nil
+}
+
+// supportSnapshot содержимое SupportSnapshot. Все ключи JSON в snake_case,
+// поэтому вложенные значения хранятся в собственных типах, а не в Parcel, ChangeRecord и Note
+type supportSnapshot struct {
+	Parcel   snapshotParcel   `json:"parcel"`
+	Metadata parcelMetadata   `json:"metadata"`
+	History  []snapshotChange `json:"history"`
+	Notes    []snapshotNote   `json:"notes"`
+}
+
+// snapshotParcel посылка в SupportSnapshot
+type snapshotParcel struct {
+	Number    int    `json:"number"`
+	Client    int    `json:"client"`
+	Status    string `json:"status"`
+	Address   string `json:"address"`
+	CreatedAt string `json:"created_at"`
+}
+
+// snapshotChange запись журнала изменений в SupportSnapshot
+type snapshotChange struct {
+	Seq int    `json:"seq"`
+	Op  string `json:"op"`
+	At  string `json:"at"`
+}
+
+// snapshotNote заметка в SupportSnapshot
+type snapshotNote struct {
+	Note string `json:"note"`
+	At   string `json:"at"`
+}
+
+// parcelMetadata служебные поля посылки, которых нет в Parcel
+type parcelMetadata struct {
+	AddressChanged  bool    `json:"address_changed"`
+	ParentNumber    *int    `json:"parent_number"`
+	ScheduledStatus *string `json:"scheduled_status"`
+	ScheduledAt     *string `json:"scheduled_at"`
+	NotifiedAt      *string `json:"notified_at"`
+	DeliveredAt     *string `json:"delivered_at"`
+}
+
+// SupportSnapshot возвращает всё, что известно о посылке, в виде отформатированного JSON
+// для обращений в поддержку: саму посылку, служебные поля, журнал изменений и заметки.
+// Данные читаются в одной транзакции
+func (s ParcelStore) SupportSnapshot(number int) ([]byte, error) {
+	if !isValidNumber(number) {
+		return nil, ErrInvalidNumber
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	view, err := s.readFullView(tx, number)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := parcelMetadata{}
+	row := tx.QueryRow("SELECT address_changed, parent_number, scheduled_status, scheduled_at, notified_at, delivered_at FROM "+s.table("parcel")+" WHERE number = :number",
+		sql.Named("number", number))
+	err = row.Scan(&meta.AddressChanged, &meta.ParentNumber, &meta.ScheduledStatus, &meta.ScheduledAt, &meta.NotifiedAt, &meta.DeliveredAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	snapshot := supportSnapshot{
+		Parcel: snapshotParcel{
+			Number:    view.Parcel.Number,
+			Client:    view.Parcel.Client,
+			Status:    view.Parcel.Status,
+			Address:   view.Parcel.Address,
+			CreatedAt: view.Parcel.CreatedAt,
+		},
+		Metadata: meta,
+		History:  make([]snapshotChange, 0, len(view.History)),
+		Notes:    make([]snapshotNote, 0, len(view.Notes)),
+	}
+	for _, c := range view.History {
+		snapshot.History = append(snapshot.History, snapshotChange{Seq: c.Seq, Op: c.Op, At: c.At})
+	}
+	for _, n := range view.Notes {
+		snapshot.Notes = append(snapshot.Notes, snapshotNote{Note: n.Note, At: n.At})
+	}
+
+	return json.MarshalIndent(snapshot, "", "  ")
+}
+
+// RepairSequence поднимает счётчик autoincrement таблицы parcel до максимального номера посылки,
+// если после ручных правок он оказался меньше, и возвращает итоговое значение счётчика
+func (s ParcelStore) RepairSequence() (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var maxNumber int
+	row := tx.QueryRow("SELECT IFNULL(MAX(number), 0) FROM " + s.table("parcel"))
+	if err := row.Scan(&maxNumber); err != nil {
+		return 0, err
+	}
+
+	// строка для parcel появляется в sqlite_sequence только после первой вставки
+	var seq sql.NullInt64
+	row = tx.QueryRow("SELECT seq FROM " + s.table("sqlite_sequence") + " WHERE name = 'parcel'")
+	err = row.Scan(&seq)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	if seq.Valid && int(seq.Int64) >= maxNumber {
+		return int(seq.Int64), nil
+	}
+
+	query := "UPDATE " + s.table("sqlite_sequence") + " SET seq = :seq WHERE name = 'parcel'"
+	if !seq.Valid {
+		query = "INSERT INTO " + s.table("sqlite_sequence") + " (name, seq) VALUES ('parcel', :seq)"
+	}
+	if _, err := tx.Exec(query, sql.Named("seq", maxNumber)); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return maxNumber, nil
+}
+
+// SameAddress возвращает другие посылки, нормализованный адрес которых совпадает с адресом посылки number.
+// Если посылки number нет, возвращает ErrParcelNotFound
+func (s ParcelStore) SameAddress(number int) ([]Parcel, error) {
+	source, err := s.Get(number)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrParcelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// адреса в БД могут быть не нормализованы, поэтому сравниваем их на стороне приложения
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number != :number ORDER BY number",
+		sql.Named("number", number))
+	if err != nil {
+		return nil, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	address := normalizeAddress(source.Address)
+	var res []Parcel
+	for _, p := range parcels {
+		if normalizeAddress(p.Address) == address {
+			res = append(res, p)
+		}
+	}
+
+	return res, nil
+}
+
+// PlanBulkSetStatus без изменения данных делит посылки клиента на те, которые можно перевести в статус to,
+// и те, для которых переход недопустим; для отклонённых возвращается причина
+func (s ParcelStore) PlanBulkSetStatus(client int, to string) (eligible []int, rejected map[int]string, err error) {
+	if !isKnownStatus(to) {
+		return nil, nil, fmt.Errorf("%w: %q", ErrInvalidStatus, to)
+	}
+
+	if !s.allowRead(client) {
+		return nil, nil, ErrRateLimited
+	}
+
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE client = :client ORDER BY number",
+		sql.Named("client", client))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rejected = make(map[int]string)
+	for _, p := range parcels {
+		if canTransition(p.Status, to) {
+			eligible = append(eligible, p.Number)
+			continue
+		}
+		rejected[p.Number] = fmt.Sprintf("transition %s -> %s is not allowed", p.Status, to)
+	}
+
+	return eligible, rejected, nil
+}
+
+// EstimatedStorageBytes оценивает место, занимаемое таблицей посылок.
+// Если SQLite собран с виртуальной таблицей dbstat, возвращается суммарный размер страниц таблицы parcel
+// (без индексов и свободного места в файле). Иначе используется грубая оценка — сумма длин значений всех строк,
+// которая не учитывает служебные заголовки страниц и записей
+func (s ParcelStore) EstimatedStorageBytes() (int64, error) {
+	schema := s.schema
+	if schema == "" {
+		schema = "main"
+	}
+
+	var size sql.NullInt64
+	err := s.db.QueryRow("SELECT SUM(pgsize) FROM dbstat(:schema) WHERE name = 'parcel'",
+		sql.Named("schema", schema)).Scan(&size)
+	if err == nil {
+		return size.Int64, nil
+	}
+
+	err = s.db.QueryRow(`SELECT SUM(LENGTH(number) + LENGTH(client) + LENGTH(status) + LENGTH(address) + LENGTH(created_at))
+		FROM ` + s.table("parcel")).Scan(&size)
+	if err != nil {
+		return 0, err
+	}
+
+	return size.Int64, nil
+}
+
+// ApplyAddressCorrections в одной транзакции заменяет адреса посылок по карте номер -> адрес.
+// Адреса нормализуются; пустой адрес или некорректный номер отменяет все исправления.
+// Исправление применяется независимо от статуса посылки. Возвращает количество обновлённых посылок
+// и упорядоченный список номеров, которых нет в БД
+func (s ParcelStore) ApplyAddressCorrections(corrections map[int]string) (applied int, notFound []int, err error) {
+	if s.isReadOnly() {
+		return 0, nil, ErrReadOnly
+	}
+
+	numbers := make([]int, 0, len(corrections))
+	for number, address := range corrections {
+		if !isValidNumber(number) {
+			return 0, nil, ErrInvalidNumber
+		}
+		if normalizeAddress(address) == "" {
+			return 0, nil, fmt.Errorf("%w: parcel %d: empty address", ErrInvalidParcel, number)
+		}
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback()
+
+	for _, number := range numbers {
+		args := []any{
+			sql.Named("address", normalizeAddress(corrections[number])),
+			sql.Named("number", number),
+			sql.Named("unique", s.uniqueAddressPerClient()),
+		}
+
+		res, err := tx.Exec(`UPDATE `+s.table("parcel")+` SET address = :address, address_changed = (address_changed OR address != :address)
+			WHERE number = :number AND `+s.uniqueAddressUpdateGuard("parcel.client"), args...)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, nil, err
+		}
+		if n == 0 {
+			taken, err := s.addressTaken(tx, "parcel.client", args...)
+			if err != nil {
+				return 0, nil, err
+			}
+			if taken {
+				return 0, nil, fmt.Errorf("parcel %d: %w", number, ErrDuplicateAddress)
+			}
+			notFound = append(notFound, number)
+			continue
+		}
+
+		if err := s.logChange(tx, number, ChangeOpSetAddress); err != nil {
+			return 0, nil, err
+		}
+		applied++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, err
+	}
+
+	return applied, notFound, nil
+}
+
+// CountSince возвращает количество посылок с номером больше checkpointNumber
+func (s ParcelStore) CountSince(checkpointNumber int) (int, error) {
+	var count int
+	err := s.db.QueryRow("SELECT COUNT(*) FROM "+s.table("parcel")+" WHERE number > :checkpoint",
+		sql.Named("checkpoint", checkpointNumber)).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// AverageStatusChanges возвращает среднее количество смен статуса на посылку
+// среди посылок, у которых в журнале изменений есть хотя бы одна смена статуса.
+// Если смен статуса не было, возвращает 0
+func (s ParcelStore) AverageStatusChanges() (float64, error) {
+	var avg sql.NullFloat64
+	err := s.db.QueryRow("SELECT CAST(COUNT(*) AS REAL) / COUNT(DISTINCT number) FROM "+s.table("parcel_changelog")+" WHERE op = :op",
+		sql.Named("op", ChangeOpSetStatus)).Scan(&avg)
+	if err != nil {
+		return 0, err
+	}
+
+	return avg.Float64, nil
+}
+
+// SingleShipmentClients возвращает упорядоченный список клиентов, у которых ровно одна посылка
+func (s ParcelStore) SingleShipmentClients() ([]int, error) {
+	rows, err := s.db.Query("SELECT client FROM " + s.table("parcel") + " GROUP BY client HAVING COUNT(*) = 1 ORDER BY client")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []int
+	for rows.Next() {
+		var client int
+		if err := rows.Scan(&client); err != nil {
+			return nil, err
+		}
+		res = append(res, client)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// DeliverAllSent в одной транзакции переводит все посылки клиента в статусе sent в статус delivered,
+// проставляет время доставки delivered_at, записывает смены статуса в журнал изменений
+// и возвращает количество доставленных посылок
+func (s ParcelStore) DeliverAllSent(client int) (int, error) {
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT number FROM "+s.table("parcel")+" WHERE client = :client AND status = :sent ORDER BY number",
+		sql.Named("client", client),
+		sql.Named("sent", ParcelStatusSent))
+	if err != nil {
+		return 0, err
+	}
+
+	var numbers []int
+	for rows.Next() {
+		var number int
+		if err := rows.Scan(&number); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		numbers = append(numbers, number)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, number := range numbers {
+		if _, err := s.updateStatus(tx, number, ParcelStatusDelivered); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	s.InvalidateClient(client)
+
+	return len(numbers), nil
+}
+
+// UndispatchedEvents возвращает до limit ещё не отправленных событий журнала изменений в порядке их записи
+func (s ParcelStore) UndispatchedEvents(limit int) ([]WebhookEvent, error) {
+	if limit <= 0 {
+		return nil, ErrInvalidLimit
+	}
+
+	rows, err := s.db.Query("SELECT seq, number, op, at FROM "+s.table("parcel_changelog")+" WHERE dispatched = 0 ORDER BY seq LIMIT :limit",
+		sql.Named("limit", limit))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []WebhookEvent
+	for rows.Next() {
+		e := WebhookEvent{}
+		if err := rows.Scan(&e.ID, &e.Number, &e.Op, &e.At); err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// MarkDispatched отмечает события ids отправленными
+// и возвращает количество событий, отмеченных этим вызовом
+func (s ParcelStore) MarkDispatched(ids []int) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	if s.isReadOnly() {
+		return 0, ErrReadOnly
+	}
+
+	list, args := inList("id", ids)
+	res, err := s.db.Exec("UPDATE "+s.table("parcel_changelog")+" SET dispatched = 1 WHERE dispatched = 0 AND seq IN ("+list+")",
+		args...)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// SnapshotCounts возвращает снимок количества посылок по статусам на текущий момент
+func (s ParcelStore) SnapshotCounts() (SnapshotCounts, error) {
+	rows, err := s.db.Query("SELECT status, COUNT(*) FROM " + s.table("parcel") + " GROUP BY status")
+	if err != nil {
+		return SnapshotCounts{}, err
+	}
+	defer rows.Close()
+
+	res := SnapshotCounts{At: time.Now().UTC(), Counts: make(map[string]int)}
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return SnapshotCounts{}, err
+		}
+		res.Counts[status] = n
+	}
+
+	if err := rows.Err(); err != nil {
+		return SnapshotCounts{}, err
+	}
+
+	return res, nil
+}
+
+// RoutesByPrefix группирует недоставленные посылки в маршруты по первым prefixLen символам нормализованного адреса.
+// Адрес короче prefixLen целиком становится ключом маршрута. Посылки внутри маршрута упорядочены по номеру
+func (s ParcelStore) RoutesByPrefix(prefixLen int) (map[string][]Parcel, error) {
+	if prefixLen <= 0 {
+		return nil, ErrInvalidPrefixLength
+	}
+
+	rows, err := s.db.Query("SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE status != :delivered ORDER BY number",
+		sql.Named("delivered", ParcelStatusDelivered))
+	if err != nil {
+		return nil, err
+	}
+
+	parcels, err := scanParcels(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]Parcel)
+	for _, p := range parcels {
+		key := []rune(normalizeAddress(p.Address))
+		if len(key) > prefixLen {
+			key = key[:prefixLen]
+		}
+		res[string(key)] = append(res[string(key)], p)
+	}
+
+	return res, nil
+}
+
+// Reindex передаёт в push посылки с номером больше fromNumber пачками до batch штук в порядке номеров.
+// Возвращает номер последней посылки из пачки, которую push принял без ошибки (или fromNumber, если таких нет):
+// после сбоя переиндексацию можно продолжить вызовом с этим номером. Для полной переиндексации fromNumber равен 0
+func (s ParcelStore) Reindex(ctx context.Context, fromNumber int, batch int, push func([]Parcel) error) (lastNumber int, err error) {
+	if batch <= 0 {
+		return fromNumber, ErrInvalidLimit
+	}
+
+	lastNumber = fromNumber
+	for {
+		if err := ctx.Err(); err != nil {
+			return lastNumber, err
+		}
+
+		rows, err := s.db.QueryContext(ctx, "SELECT number, client, status, address, created_at FROM "+s.table("parcel")+" WHERE number > :from ORDER BY number LIMIT :limit",
+			sql.Named("from", lastNumber),
+			sql.Named("limit", batch))
+		if err != nil {
+			return lastNumber, err
+		}
+
+		parcels, err := scanParcels(rows)
+		if err != nil {
+			return lastNumber, err
+		}
+		if len(parcels) == 0 {
+			return lastNumber, nil
+		}
+
+		if err := push(parcels); err != nil {
+			return lastNumber, err
+		}
+		lastNumber = parcels[len(parcels)-1].Number
+
+		if len(parcels) < batch {
+			return lastNumber, nil
+		}
+	}
+}
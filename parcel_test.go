@@ -1,11 +1,22 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,60 +39,113 @@ func getTestParcel() Parcel {
 	}
 }
 
+// newTestDB открывает пустую БД во временном каталоге и создаёт в ней схему через EnsureSchema,
+// чтобы тесты не зависели от уже сохранённых в tracker.db данных
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "tracker.db")+"?_pragma=busy_timeout(5000)")
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	require.NoError(t, EnsureSchema(db))
+
+	return db
+}
+
+// testSchema возвращает операторы CREATE для таблиц и индексов tracker.db
+func testSchema(t *testing.T) []string {
+	t.Helper()
+
+	src, err := sql.Open("sqlite", "tracker.db")
+	require.NoError(t, err)
+	defer src.Close()
+
+	rows, err := src.Query("SELECT sql FROM sqlite_master WHERE sql IS NOT NULL AND name NOT LIKE 'sqlite_%' ORDER BY rowid")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var schema []string
+	for rows.Next() {
+		var query string
+		require.NoError(t, rows.Scan(&query))
+		schema = append(schema, query)
+	}
+	require.NoError(t, rows.Err())
+
+	return schema
+}
+
 // TestAddGetDelete проверяет добавление, получение и удаление посылки
 func TestAddGetDelete(t *testing.T) {
 	// prepare
-	db, err := // настройте подключение к БД
-	store := NewParcelStore(db)
+	store := NewParcelStore(newTestDB(t))
 	parcel := getTestParcel()
 
 	// add
-	// добавьте новую посылку в БД, убедитесь в отсутствии ошибки и наличии идентификатора
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
+	parcel.Number = id
 
 	// get
-	// получите только что добавленную посылку, убедитесь в отсутствии ошибки
-	// проверьте, что значения всех полей в полученном объекте совпадают со значениями полей в переменной parcel
+	stored, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, parcel, stored)
 
 	// delete
-	// удалите добавленную посылку, убедитесь в отсутствии ошибки
-	// проверьте, что посылку больше нельзя получить из БД
+	err = store.Delete(id)
+	require.NoError(t, err)
+
+	_, err = store.Get(id)
+	require.ErrorIs(t, err, sql.ErrNoRows)
 }
 
 // TestSetAddress проверяет обновление адреса
 func TestSetAddress(t *testing.T) {
 	// prepare
-	db, err := // настройте подключение к БД
+	store := NewParcelStore(newTestDB(t))
 
 	// add
-	// добавьте новую посылку в БД, убедитесь в отсутствии ошибки и наличии идентификатора
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
 
 	// set address
-	// обновите адрес, убедитесь в отсутствии ошибки
 	newAddress := "new test address"
+	err = store.SetAddress(id, newAddress)
+	require.NoError(t, err)
 
 	// check
-	// получите добавленную посылку и убедитесь, что адрес обновился
+	stored, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, newAddress, stored.Address)
 }
 
 // TestSetStatus проверяет обновление статуса
 func TestSetStatus(t *testing.T) {
 	// prepare
-	db, err := // настройте подключение к БД
+	store := NewParcelStore(newTestDB(t))
 
 	// add
-	// добавьте новую посылку в БД, убедитесь в отсутствии ошибки и наличии идентификатора
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NotEmpty(t, id)
 
 	// set status
-	// обновите статус, убедитесь в отсутствии ошибки
+	err = store.SetStatus(id, ParcelStatusSent)
+	require.NoError(t, err)
 
 	// check
-	// получите добавленную посылку и убедитесь, что статус обновился
+	stored, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusSent, stored.Status)
 }
 
 // TestGetByClient проверяет получение посылок по идентификатору клиента
 func TestGetByClient(t *testing.T) {
 	// prepare
-	db, err := // настройте подключение к БД
+	store := NewParcelStore(newTestDB(t))
 
 	parcels := []Parcel{
 		getTestParcel(),
@@ -98,7 +162,9 @@ func TestGetByClient(t *testing.T) {
 
 	// add
 	for i := 0; i < len(parcels); i++ {
-		id, err := // добавьте новую посылку в БД, убедитесь в отсутствии ошибки и наличии идентификатора
+		id, err := store.Add(parcels[i])
+		require.NoError(t, err)
+		require.NotEmpty(t, id)
 
 		// обновляем идентификатор добавленной у посылки
 		parcels[i].Number = id
@@ -108,14 +174,2538 @@ func TestGetByClient(t *testing.T) {
 	}
 
 	// get by client
-	storedParcels, err := // получите список посылок по идентификатору клиента, сохранённого в переменной client
-	// убедитесь в отсутствии ошибки
-	// убедитесь, что количество полученных посылок совпадает с количеством добавленных
+	storedParcels, err := store.GetByClient(client)
+	require.NoError(t, err)
+	require.Len(t, storedParcels, len(parcels))
 
 	// check
 	for _, parcel := range storedParcels {
-		// в parcelMap лежат добавленные посылки, ключ - идентификатор посылки, значение - сама посылка
-		// убедитесь, что все посылки из storedParcels есть в parcelMap
-		// убедитесь, что значения полей полученных посылок заполнены верно
+		expected, ok := parcelMap[parcel.Number]
+		require.True(t, ok)
+		assert.Equal(t, expected, parcel)
+	}
+}
+
+// TestAddPartialBatch проверяет пакетное добавление посылок со значениями по умолчанию
+func TestAddPartialBatch(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	client := randRange.Intn(10_000_000)
+	entries := []struct {
+		Client  int
+		Address string
+	}{
+		{Client: client, Address: "first"},
+		{Client: client, Address: "second"},
+		{Client: client, Address: "third"},
+	}
+
+	// add
+	ids, err := store.AddPartialBatch(entries)
+	require.NoError(t, err)
+	require.Len(t, ids, len(entries))
+
+	// check
+	for i, id := range ids {
+		stored, err := store.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, entries[i].Client, stored.Client)
+		assert.Equal(t, entries[i].Address, stored.Address)
+		assert.Equal(t, ParcelStatusRegistered, stored.Status)
+
+		_, err = time.Parse(time.RFC3339, stored.CreatedAt)
+		assert.NoError(t, err)
+	}
+}
+
+// TestDateSpan проверяет получение диапазона дат создания посылок
+func TestDateSpan(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	// empty
+	_, _, err := store.DateSpan()
+	require.ErrorIs(t, err, ErrNoParcels)
+
+	// add
+	base := time.Date(2024, time.January, 10, 12, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{48 * time.Hour, 0, 24 * time.Hour, 72 * time.Hour} {
+		parcel := getTestParcel()
+		parcel.CreatedAt = base.Add(offset).Format(time.RFC3339)
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	earliest, latest, err := store.DateSpan()
+	require.NoError(t, err)
+	assert.True(t, base.Equal(earliest))
+	assert.True(t, base.Add(72*time.Hour).Equal(latest))
+}
+
+// TestGetByNumberRange проверяет получение посылок по диапазону номеров
+func TestGetByNumberRange(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	// add
+	ids := make([]int, 5)
+	for i := range ids {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		ids[i] = id
+	}
+
+	// get by range
+	parcels, err := store.GetByNumberRange(ids[1], ids[3])
+	require.NoError(t, err)
+	require.Len(t, parcels, 3)
+
+	// check
+	for i, parcel := range parcels {
+		assert.Equal(t, ids[i+1], parcel.Number)
+	}
+
+	// invalid range
+	_, err = store.GetByNumberRange(ids[3], ids[1])
+	require.ErrorIs(t, err, ErrInvalidRange)
+}
+
+// TestAutoAdvance проверяет автоматическую смену статуса у давно созданных посылок
+func TestAutoAdvance(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	old := getTestParcel()
+	old.CreatedAt = time.Now().UTC().Add(-48 * time.Hour).Format(time.RFC3339)
+	oldID, err := store.Add(old)
+	require.NoError(t, err)
+
+	freshID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// advance
+	n, err := store.AutoAdvance(ParcelStatusRegistered, ParcelStatusSent, 24*time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// check
+	stored, err := store.Get(oldID)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusSent, stored.Status)
+
+	stored, err = store.Get(freshID)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusRegistered, stored.Status)
+}
+
+// TestSetReadOnly проверяет режим только для чтения
+func TestSetReadOnly(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// read-only
+	store.SetReadOnly(true)
+
+	_, err = store.Add(getTestParcel())
+	require.ErrorIs(t, err, ErrReadOnly)
+
+	_, err = store.Get(id)
+	require.NoError(t, err)
+
+	// read-write
+	store.SetReadOnly(false)
+
+	_, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+}
+
+// TestExportFixedWidth проверяет выгрузку посылок в формате с фиксированной шириной колонок
+func TestExportFixedWidth(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	short := getTestParcel()
+	short.Address = "Псков"
+	shortID, err := store.Add(short)
+	require.NoError(t, err)
+
+	long := getTestParcel()
+	long.Status = ParcelStatusDelivered
+	long.Address = strings.Repeat("адрес ", 10)
+	_, err = store.Add(long)
+	require.NoError(t, err)
+
+	// export
+	var buf bytes.Buffer
+	err = store.ExportFixedWidth(&buf)
+	require.NoError(t, err)
+
+	// check
+	var lines []string
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	require.NoError(t, scanner.Err())
+	require.Len(t, lines, 2)
+
+	width := FixedWidthNumber + FixedWidthClient + FixedWidthStatus + FixedWidthAddress
+	for _, line := range lines {
+		assert.Equal(t, width, utf8.RuneCountInString(line))
+	}
+
+	fields := []rune(lines[0])
+	assert.Equal(t, fmt.Sprintf("%-8d", shortID), string(fields[:8]))
+	assert.Equal(t, "1000      ", string(fields[8:18]))
+	assert.Equal(t, "registered  ", string(fields[18:30]))
+	assert.Equal(t, "Псков"+strings.Repeat(" ", 35), string(fields[30:]))
+
+	fields = []rune(lines[1])
+	assert.Equal(t, "delivered   ", string(fields[18:30]))
+	assert.Equal(t, string([]rune(long.Address)[:40]), string(fields[30:]))
+}
+
+// TestPoolStats проверяет статистику пула соединений
+func TestPoolStats(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	// каждая открытая транзакция удерживает своё соединение
+	tx1, err := db.Begin()
+	require.NoError(t, err)
+	defer tx1.Rollback()
+
+	tx2, err := db.Begin()
+	require.NoError(t, err)
+	defer tx2.Rollback()
+
+	// check
+	assert.Equal(t, 2, store.InUse())
+	assert.GreaterOrEqual(t, store.PoolStats().OpenConnections, 2)
+
+	require.NoError(t, tx1.Rollback())
+	require.NoError(t, tx2.Rollback())
+	assert.Equal(t, 0, store.InUse())
+}
+
+// TestInvalidNumber проверяет, что заведомо несуществующие номера отклоняются без обращения к БД
+func TestInvalidNumber(t *testing.T) {
+	// prepare
+	// на закрытой БД любой запрос вернул бы ошибку "sql: database is closed",
+	// поэтому ErrInvalidNumber означает, что до запроса дело не дошло
+	db := newTestDB(t)
+	require.NoError(t, db.Close())
+	store := NewParcelStore(db)
+
+	// check
+	for _, number := range []int{0, -5} {
+		_, err := store.Get(number)
+		require.ErrorIs(t, err, ErrInvalidNumber)
+
+		require.ErrorIs(t, store.SetStatus(number, ParcelStatusSent), ErrInvalidNumber)
+		require.ErrorIs(t, store.SetAddress(number, "test"), ErrInvalidNumber)
+		require.ErrorIs(t, store.Delete(number), ErrInvalidNumber)
+	}
+}
+
+// TestDumpSQL проверяет, что выгруженный скрипт восстанавливает те же данные в новой БД
+func TestDumpSQL(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	parcels := []Parcel{getTestParcel(), getTestParcel()}
+	parcels[1].Address = "ул. O'Connor; д. 1"
+	for i := range parcels {
+		id, err := store.Add(parcels[i])
+		require.NoError(t, err)
+		parcels[i].Number = id
+	}
+
+	// dump
+	var buf bytes.Buffer
+	err := store.DumpSQL(&buf)
+	require.NoError(t, err)
+
+	// replay
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "replay.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec(buf.String())
+	require.NoError(t, err)
+
+	// check
+	restored, err := NewParcelStore(db).GetByClient(parcels[0].Client)
+	require.NoError(t, err)
+	assert.Equal(t, parcels, restored)
+}
+
+// TestFutureDated проверяет поиск и исправление посылок со временем создания из будущего
+func TestFutureDated(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	future := getTestParcel()
+	future.CreatedAt = time.Now().UTC().Add(24 * time.Hour).Format(time.RFC3339)
+	futureID, err := store.Add(future)
+	require.NoError(t, err)
+
+	_, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// detect
+	parcels, err := store.GetFutureDated()
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+	assert.Equal(t, futureID, parcels[0].Number)
+
+	// clamp
+	n, err := store.ClampFutureDates()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// check
+	parcels, err = store.GetFutureDated()
+	require.NoError(t, err)
+	assert.Empty(t, parcels)
+}
+
+// TestFunnel проверяет подсчёт посылок по этапам доставки
+func TestFunnel(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	// посылка с неизвестным статусом в воронку не попадает
+	_, err := db.Exec("INSERT INTO parcel (client, status, address, created_at) VALUES (1, 'lost', 'test', '2024-01-01T00:00:00Z')")
+	require.NoError(t, err)
+
+	// две посылки остаются зарегистрированными, две отправлены, одна из них доставлена
+	statuses := []string{
+		ParcelStatusRegistered,
+		ParcelStatusRegistered,
+		ParcelStatusSent,
+		ParcelStatusDelivered,
+	}
+	for _, status := range statuses {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+
+		if status == ParcelStatusRegistered {
+			continue
+		}
+		require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+		if status == ParcelStatusDelivered {
+			require.NoError(t, store.SetStatus(id, ParcelStatusDelivered))
+		}
+	}
+
+	// check
+	registered, sent, delivered, err := store.Funnel()
+	require.NoError(t, err)
+	assert.Equal(t, 4, registered)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 1, delivered)
+	assert.GreaterOrEqual(t, registered, sent)
+	assert.GreaterOrEqual(t, sent, delivered)
+}
+
+// TestConsumerGroups проверяет независимую обработку посылок разными группами потребителей
+func TestConsumerGroups(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	ids := make([]int, 3)
+	for i := range ids {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		ids[i] = id
+	}
+
+	// fetch
+	for _, group := range []string{"billing", "notify"} {
+		parcels, err := store.FetchUnconsumed(group, 10)
+		require.NoError(t, err)
+		assert.Len(t, parcels, len(ids))
+	}
+
+	// mark consumed
+	err := store.MarkConsumed("billing", ids[:2])
+	require.NoError(t, err)
+
+	// check
+	parcels, err := store.FetchUnconsumed("billing", 10)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+	assert.Equal(t, ids[2], parcels[0].Number)
+
+	parcels, err = store.FetchUnconsumed("notify", 10)
+	require.NoError(t, err)
+	assert.Len(t, parcels, len(ids))
+
+	parcels, err = store.FetchUnconsumed("notify", 2)
+	require.NoError(t, err)
+	assert.Len(t, parcels, 2)
+
+	_, err = store.FetchUnconsumed("notify", 0)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+// TestParcelString проверяет краткое описание посылки для логов
+func TestParcelString(t *testing.T) {
+	parcel := Parcel{
+		Number:    42,
+		Client:    1000,
+		Status:    ParcelStatusSent,
+		Address:   "Псков, ул. Колотушкина, д. 5",
+		CreatedAt: "2024-01-10T12:00:00Z",
+	}
+
+	str := parcel.String()
+	assert.Equal(t, "Parcel#42 client=1000 status=sent addr=Пс*** created=2024-01-10T12:00:00Z", str)
+	assert.NotContains(t, str, "Колотушкина")
+	assert.Equal(t, str, fmt.Sprint(parcel))
+}
+
+// TestValidateBatch проверяет поэлементную проверку пакета посылок
+func TestValidateBatch(t *testing.T) {
+	// prepare
+	parcels := make([]Parcel, 6)
+	for i := range parcels {
+		parcels[i] = getTestParcel()
+	}
+	parcels[1].Client = 0
+	parcels[3].Status = "lost"
+	parcels[4].Address = "  "
+	parcels[5].CreatedAt = "yesterday"
+
+	// validate
+	results := ValidateBatch(parcels)
+	require.Len(t, results, len(parcels))
+
+	// check
+	var invalid []int
+	for i, res := range results {
+		assert.Equal(t, i, res.Index)
+		if res.Err != nil {
+			assert.ErrorIs(t, res.Err, ErrInvalidParcel)
+			invalid = append(invalid, res.Index)
+		}
+	}
+	assert.Equal(t, []int{1, 3, 4, 5}, invalid)
+}
+
+// TestCreationRateByClient проверяет подсчёт скорости создания посылок по клиентам
+func TestCreationRateByClient(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	busy, quiet := 1, 2
+	for i := 0; i < 10; i++ {
+		parcel := getTestParcel()
+		parcel.Client = busy
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	parcel := getTestParcel()
+	parcel.Client = quiet
+	_, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// старая посылка не попадает в окно
+	parcel.CreatedAt = time.Now().UTC().Add(-time.Hour).Format(time.RFC3339)
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	rates, err := store.CreationRateByClient(5 * time.Minute)
+	require.NoError(t, err)
+	assert.InDelta(t, 2.0, rates[busy], 1e-9)
+	assert.InDelta(t, 0.2, rates[quiet], 1e-9)
+	assert.Greater(t, rates[busy], rates[quiet])
+
+	_, err = store.CreationRateByClient(0)
+	require.ErrorIs(t, err, ErrInvalidRange)
+}
+
+// TestGetByClientSortedByPostal проверяет сортировку посылок клиента по числу в начале адреса
+func TestGetByClientSortedByPostal(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	for _, address := range []string{"no-number Z", "12 X", "3 Y"} {
+		parcel := getTestParcel()
+		parcel.Address = address
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// get
+	parcels, err := store.GetByClientSortedByPostal(getTestParcel().Client)
+	require.NoError(t, err)
+
+	// check
+	var addresses []string
+	for _, parcel := range parcels {
+		addresses = append(addresses, parcel.Address)
+	}
+	assert.Equal(t, []string{"3 Y", "12 X", "no-number Z"}, addresses)
+}
+
+// TestAddIfUnderQuota проверяет, что параллельные вставки не превышают лимит клиента
+func TestAddIfUnderQuota(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	maxActive := 3
+
+	for i := 0; i < maxActive-1; i++ {
+		_, err := store.AddIfUnderQuota(getTestParcel(), maxActive)
+		require.NoError(t, err)
+	}
+
+	// race
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = store.AddIfUnderQuota(getTestParcel(), maxActive)
+		}(i)
+	}
+	wg.Wait()
+
+	// check
+	succeeded := 0
+	for _, err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		assert.ErrorIs(t, err, ErrClientLimitExceeded)
+	}
+	assert.Equal(t, 1, succeeded)
+
+	parcels, err := store.GetByClient(getTestParcel().Client)
+	require.NoError(t, err)
+	assert.Len(t, parcels, maxActive)
+}
+
+// TestGetByStatuses проверяет получение посылок по нескольким статусам
+func TestGetByStatuses(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	expected := map[int]string{}
+	for _, status := range []string{ParcelStatusRegistered, ParcelStatusSent, ParcelStatusDelivered} {
+		parcel := getTestParcel()
+		parcel.Status = status
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+
+		if status != ParcelStatusSent {
+			expected[id] = status
+		}
+	}
+
+	// get
+	parcels, err := store.GetByStatuses([]string{ParcelStatusRegistered, ParcelStatusDelivered})
+	require.NoError(t, err)
+
+	// check
+	require.Len(t, parcels, len(expected))
+	for _, parcel := range parcels {
+		assert.Equal(t, expected[parcel.Number], parcel.Status)
+	}
+
+	parcels, err = store.GetByStatuses(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, parcels)
+	assert.Empty(t, parcels)
+}
+
+// TestWaitForStatus проверяет ожидание нужного статуса посылки
+func TestWaitForStatus(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		store.SetStatus(id, ParcelStatusSent)
+	}()
+
+	// wait
+	err = store.WaitForStatus(ctx, id, ParcelStatusSent, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	// timeout
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer shortCancel()
+
+	err = store.WaitForStatus(shortCtx, id, ParcelStatusDelivered, 10*time.Millisecond)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// not found
+	err = store.WaitForStatus(ctx, id+1, ParcelStatusSent, 10*time.Millisecond)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// invalid poll interval
+	err = store.WaitForStatus(ctx, id, ParcelStatusSent, 0)
+	require.ErrorIs(t, err, ErrInvalidPollInterval)
+}
+
+// TestCreationByWeekday проверяет распределение созданных посылок по дням недели
+func TestCreationByWeekday(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	// 2024-01-08 — понедельник, 2024-01-10 — среда
+	dates := []string{
+		"2024-01-08T09:00:00Z",
+		"2024-01-08T18:30:00Z",
+		"2024-01-10T12:00:00Z",
+	}
+	for _, date := range dates {
+		parcel := getTestParcel()
+		parcel.CreatedAt = date
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	byWeekday, err := store.CreationByWeekday()
+	require.NoError(t, err)
+	assert.Equal(t, map[time.Weekday]int{time.Monday: 2, time.Wednesday: 1}, byWeekday)
+}
+
+// TestNotes проверяет добавление и получение заметок посылки
+func TestNotes(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// add
+	require.NoError(t, store.AddNote(id, "клиент просил позвонить"))
+	require.NoError(t, store.AddNote(id, "дозвонились"))
+
+	// check
+	notes, err := store.GetNotes(id)
+	require.NoError(t, err)
+	require.Len(t, notes, 2)
+	assert.Equal(t, "клиент просил позвонить", notes[0].Note)
+	assert.Equal(t, "дозвонились", notes[1].Note)
+	for _, note := range notes {
+		assert.Equal(t, id, note.ParcelNumber)
+	}
+
+	// not found
+	err = store.AddNote(id+1, "test")
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestStatusViewByClient проверяет получение номеров и статусов посылок клиента
+func TestStatusViewByClient(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	for _, status := range []string{ParcelStatusRegistered, ParcelStatusSent, ParcelStatusDelivered} {
+		parcel := getTestParcel()
+		parcel.Status = status
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	client := getTestParcel().Client
+	parcels, err := store.GetByClient(client)
+	require.NoError(t, err)
+
+	// get
+	views, err := store.StatusViewByClient(client)
+	require.NoError(t, err)
+
+	// check
+	require.Len(t, views, len(parcels))
+	for i, parcel := range parcels {
+		assert.Equal(t, ParcelStatusView{Number: parcel.Number, Status: parcel.Status}, views[i])
+	}
+}
+
+// TestGetAddressChanged проверяет отметку посылок с изменённым адресом
+func TestGetAddressChanged(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	changedID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	untouchedID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// адрес, совпадающий с текущим, изменением не считается
+	require.NoError(t, store.SetAddress(untouchedID, getTestParcel().Address))
+
+	// set address
+	require.NoError(t, store.SetAddress(changedID, "new test address"))
+
+	// check
+	parcels, err := store.GetAddressChanged()
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+	assert.Equal(t, changedID, parcels[0].Number)
+	assert.Equal(t, "new test address", parcels[0].Address)
+}
+
+// TestOpenEncryptedDB проверяет, что без поддержки шифрования в драйвере БД не открывается
+func TestOpenEncryptedDB(t *testing.T) {
+	// prepare
+	path := filepath.Join(t.TempDir(), "encrypted.db")
+
+	db, err := OpenEncryptedDB(path, "it's a secret")
+	if errors.Is(err, ErrEncryptionUnsupported) {
+		assert.Nil(t, db)
+		t.Skip("sqlite driver is built without encryption support")
 	}
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("CREATE TABLE test (id integer)")
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// wrong key
+	_, err = OpenEncryptedDB(path, "wrong")
+	require.ErrorIs(t, err, ErrWrongKey)
+
+	// right key
+	db, err = OpenEncryptedDB(path, "it's a secret")
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO test (id) VALUES (1)")
+	require.NoError(t, err)
+}
+
+// TestCachedClientSummary проверяет кэширование сводки клиента
+func TestCachedClientSummary(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+	parcel := getTestParcel()
+
+	_, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	summary, err := store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 1, Registered: 1}, summary)
+
+	// посылка, добавленная в обход хранилища, не видна, пока сводка берётся из кэша
+	_, err = db.Exec("INSERT INTO parcel (client, status, address, created_at) VALUES (:client, :status, :address, :created_at)",
+		sql.Named("client", parcel.Client),
+		sql.Named("status", ParcelStatusSent),
+		sql.Named("address", parcel.Address),
+		sql.Named("created_at", parcel.CreatedAt))
+	require.NoError(t, err)
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, 1, summary.Total)
+
+	// invalidate
+	store.InvalidateClient(parcel.Client)
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 2, Registered: 1, Sent: 1}, summary)
+
+	// изменения через хранилище сбрасывают сводку сами
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 3, Registered: 2, Sent: 1}, summary)
+
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 3, Registered: 1, Sent: 2}, summary)
+
+	_, err = store.DeliverAllSent(parcel.Client)
+	require.NoError(t, err)
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 3, Registered: 1, Delivered: 2}, summary)
+
+	// ttl
+	store.SetSummaryTTL(0)
+
+	_, err = db.Exec("DELETE FROM parcel WHERE status = :status", sql.Named("status", ParcelStatusRegistered))
+	require.NoError(t, err)
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, 2, summary.Total)
+}
+
+// TestZeroValueStore проверяет, что хранилище, созданное без NewParcelStore, работает без кэша сводок
+func TestZeroValueStore(t *testing.T) {
+	// prepare
+	store := ParcelStore{db: newTestDB(t)}
+	parcel := getTestParcel()
+
+	// add
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	summary, err := store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 1, Registered: 1}, summary)
+
+	// set status
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+
+	summary, err = store.CachedClientSummary(parcel.Client)
+	require.NoError(t, err)
+	assert.Equal(t, ClientSummary{Client: parcel.Client, Total: 1, Sent: 1}, summary)
+}
+
+// TestImportSlice проверяет импорт посылок при каждом способе разрешения конфликтов
+func TestImportSlice(t *testing.T) {
+	tests := []struct {
+		name            string
+		mode            ConflictMode
+		expected        ImportResult
+		expectedAddress string
+		wantErr         error
+	}{
+		{name: "error", mode: ConflictError, expectedAddress: "existing", wantErr: ErrParcelExists},
+		{name: "skip", mode: ConflictSkip, expected: ImportResult{Inserted: 2, Skipped: 1}, expectedAddress: "existing"},
+		{name: "replace", mode: ConflictReplace, expected: ImportResult{Inserted: 2, Replaced: 1}, expectedAddress: "imported"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// prepare
+			store := NewParcelStore(newTestDB(t))
+
+			existing := getTestParcel()
+			existing.Address = "existing"
+			id, err := store.Add(existing)
+			require.NoError(t, err)
+
+			conflicting := getTestParcel()
+			conflicting.Number = id
+			conflicting.Address = "imported"
+
+			explicit := getTestParcel()
+			explicit.Number = id + 100
+
+			// import
+			res, err := store.ImportSlice([]Parcel{getTestParcel(), conflicting, explicit}, tt.mode)
+			require.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.expected, res)
+
+			// check
+			stored, err := store.Get(id)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedAddress, stored.Address)
+
+			parcels, err := store.GetByClient(existing.Client)
+			require.NoError(t, err)
+			assert.Len(t, parcels, 1+tt.expected.Inserted)
+
+			if tt.wantErr == nil {
+				_, err = store.Get(explicit.Number)
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestAverageParcelsPerClient проверяет среднее количество посылок на клиента
+func TestAverageParcelsPerClient(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	avg, err := store.AverageParcelsPerClient()
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+
+	// add
+	for _, client := range []int{1, 1, 1, 2, 2, 3} {
+		parcel := getTestParcel()
+		parcel.Client = client
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	avg, err = store.AverageParcelsPerClient()
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, avg)
+}
+
+// TestHealth проверяет отчёт о состоянии хранилища
+func TestHealth(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	_, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// healthy
+	report := store.Health(context.Background())
+	assert.Equal(t, HealthReport{Reachable: true, IntegrityOK: true, TotalParcels: 1}, report)
+
+	// closed
+	require.NoError(t, db.Close())
+
+	report = store.Health(context.Background())
+	assert.False(t, report.Reachable)
+	assert.False(t, report.IntegrityOK)
+	assert.NotEmpty(t, report.Err)
+}
+
+// TestSplit проверяет разделение посылки на дочерние
+func TestSplit(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	parcel := getTestParcel()
+
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// split
+	ids, err := store.Split(id, 3)
+	require.NoError(t, err)
+	require.Len(t, ids, 3)
+
+	// check
+	children, err := store.Children(id)
+	require.NoError(t, err)
+	require.Len(t, children, 3)
+	for i, child := range children {
+		assert.Equal(t, ids[i], child.Number)
+		assert.Equal(t, parcel.Client, child.Client)
+		assert.Equal(t, parcel.Address, child.Address)
+		assert.Equal(t, ParcelStatusRegistered, child.Status)
+
+		grandchildren, err := store.Children(child.Number)
+		require.NoError(t, err)
+		assert.Empty(t, grandchildren)
+	}
+
+	// not found
+	_, err = store.Split(ids[2]+1, 2)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+
+	// invalid child count
+	_, err = store.Split(id, 0)
+	require.ErrorIs(t, err, ErrInvalidChildCount)
+}
+
+// TestClientDiff проверяет сравнение посылок двух клиентов по адресу
+func TestClientDiff(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	a, b := 1, 2
+
+	add := func(client int, address string) {
+		parcel := getTestParcel()
+		parcel.Client = client
+		parcel.Address = address
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+	add(a, "shared")
+	add(a, "only a")
+	add(b, "shared")
+	add(b, "only b 1")
+	add(b, "only b 2")
+
+	// diff
+	onlyA, onlyB, err := store.ClientDiff(a, b)
+	require.NoError(t, err)
+
+	// check
+	addresses := func(parcels []Parcel) []string {
+		var res []string
+		for _, parcel := range parcels {
+			res = append(res, parcel.Address)
+		}
+		return res
+	}
+	assert.Equal(t, []string{"only a"}, addresses(onlyA))
+	assert.Equal(t, []string{"only b 1", "only b 2"}, addresses(onlyB))
+}
+
+// TestChangesSince проверяет журнал изменений посылок
+func TestChangesSince(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	first, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetAddress(first, "new test address"))
+	require.NoError(t, store.SetStatus(first, ParcelStatusSent))
+
+	// отправленную посылку удалить нельзя, поэтому в журнал это не попадает
+	require.NoError(t, store.Delete(first))
+
+	second, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.Delete(second))
+
+	// check
+	changes, err := store.ChangesSince(0, 10)
+	require.NoError(t, err)
+
+	expected := []ChangeRecord{
+		{Number: first, Op: ChangeOpAdd},
+		{Number: first, Op: ChangeOpSetAddress},
+		{Number: first, Op: ChangeOpSetStatus},
+		{Number: second, Op: ChangeOpAdd},
+		{Number: second, Op: ChangeOpDelete},
+	}
+	require.Len(t, changes, len(expected))
+	for i, change := range changes {
+		assert.Equal(t, expected[i].Number, change.Number)
+		assert.Equal(t, expected[i].Op, change.Op)
+		if i > 0 {
+			assert.Greater(t, change.Seq, changes[i-1].Seq)
+		}
+	}
+
+	// since
+	rest, err := store.ChangesSince(changes[2].Seq, 1)
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	assert.Equal(t, changes[3], rest[0])
+}
+
+// TestWeeklyCohorts проверяет группировку посылок по неделям создания
+func TestWeeklyCohorts(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	parcels := []struct {
+		createdAt string
+		status    string
+	}{
+		// 2024-01-15 и 2024-01-21 — понедельник и воскресенье третьей недели
+		{createdAt: "2024-01-15T10:00:00Z", status: ParcelStatusDelivered},
+		{createdAt: "2024-01-21T23:00:00Z", status: ParcelStatusSent},
+		{createdAt: "2024-01-22T08:00:00Z", status: ParcelStatusDelivered},
+		{createdAt: "2024-01-23T08:00:00Z", status: ParcelStatusDelivered},
+		{createdAt: "2024-01-24T08:00:00Z", status: ParcelStatusRegistered},
+	}
+	for _, p := range parcels {
+		parcel := getTestParcel()
+		parcel.CreatedAt = p.createdAt
+		parcel.Status = p.status
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	cohorts, err := store.WeeklyCohorts()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]CohortStats{
+		"2024-W03": {Created: 2, Delivered: 1},
+		"2024-W04": {Created: 3, Delivered: 2},
+	}, cohorts)
+}
+
+// TestMoveTo проверяет перенос посылки в другое хранилище
+func TestMoveTo(t *testing.T) {
+	// prepare
+	src := NewParcelStore(newTestDB(t))
+	dst := NewParcelStore(newTestDB(t))
+	parcel := getTestParcel()
+
+	id, err := src.Add(parcel)
+	require.NoError(t, err)
+
+	// move
+	movedID, err := src.MoveTo(id, dst)
+	require.NoError(t, err)
+
+	// check
+	_, err = src.Get(id)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	moved, err := dst.Get(movedID)
+	require.NoError(t, err)
+	parcel.Number = movedID
+	assert.Equal(t, parcel, moved)
+}
+
+// TestMoveToFailure проверяет, что исходная посылка сохраняется, если вставка в другое хранилище не удалась
+func TestMoveToFailure(t *testing.T) {
+	// prepare
+	src := NewParcelStore(newTestDB(t))
+
+	dstDB := newTestDB(t)
+	require.NoError(t, dstDB.Close())
+	dst := NewParcelStore(dstDB)
+
+	id, err := src.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// move
+	_, err = src.MoveTo(id, dst)
+	require.Error(t, err)
+
+	// check
+	_, err = src.Get(id)
+	require.NoError(t, err)
+}
+
+// TestMoveToSameDB проверяет перенос посылки в подключённую схему той же БД
+func TestMoveToSameDB(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	// подключённая БД видна только в своём соединении, поэтому оставляем в пуле одно
+	db.SetMaxOpenConns(1)
+
+	_, err := db.Exec("ATTACH DATABASE ':memory:' AS archive")
+	require.NoError(t, err)
+
+	for _, query := range testSchema(t) {
+		query = strings.Replace(query, "CREATE TABLE ", "CREATE TABLE archive.", 1)
+		query = strings.Replace(query, "CREATE INDEX ", "CREATE INDEX archive.", 1)
+		_, err := db.Exec(query)
+		require.NoError(t, err)
+	}
+
+	store := NewParcelStore(db)
+	archive := store.WithSchema("archive")
+	parcel := getTestParcel()
+
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// move
+	done := make(chan struct{})
+	var movedID int
+	go func() {
+		defer close(done)
+		movedID, err = store.MoveTo(id, archive)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("MoveTo did not finish")
+	}
+	require.NoError(t, err)
+
+	// check
+	_, err = store.Get(id)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	moved, err := archive.Get(movedID)
+	require.NoError(t, err)
+	parcel.Number = movedID
+	assert.Equal(t, parcel, moved)
+}
+
+// TestDumpOrdered проверяет, что выгрузка одинаковых данных сериализуется одинаково
+func TestDumpOrdered(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	empty, err := store.DumpOrdered()
+	require.NoError(t, err)
+	data, err := json.Marshal(empty)
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(data))
+
+	for _, address := range []string{"b", "a", "c"} {
+		parcel := getTestParcel()
+		parcel.Address = address
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// dump
+	first, err := store.DumpOrdered()
+	require.NoError(t, err)
+	second, err := store.DumpOrdered()
+	require.NoError(t, err)
+
+	// check
+	for i := 1; i < len(first); i++ {
+		assert.Less(t, first[i-1].Number, first[i].Number)
+	}
+
+	firstJSON, err := json.Marshal(first)
+	require.NoError(t, err)
+	secondJSON, err := json.Marshal(second)
+	require.NoError(t, err)
+	assert.Equal(t, firstJSON, secondJSON)
+}
+
+// TestApplyDueSchedules проверяет применение запланированной смены статуса
+func TestApplyDueSchedules(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	now := time.Now()
+
+	dueID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.ScheduleStatus(dueID, ParcelStatusSent, now.Add(-time.Hour)))
+
+	futureID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.ScheduleStatus(futureID, ParcelStatusSent, now.Add(time.Hour)))
+
+	require.ErrorIs(t, store.ScheduleStatus(futureID, "lost", now), ErrInvalidStatus)
+	require.ErrorIs(t, store.ScheduleStatus(futureID+1, ParcelStatusSent, now), ErrParcelNotFound)
+
+	// apply
+	n, err := store.ApplyDueSchedules(now)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// check
+	due, err := store.Get(dueID)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusSent, due.Status)
+
+	future, err := store.Get(futureID)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusRegistered, future.Status)
+
+	changes, err := store.ChangesSince(0, 10)
+	require.NoError(t, err)
+	last := changes[len(changes)-1]
+	assert.Equal(t, dueID, last.Number)
+	assert.Equal(t, ChangeOpSetStatus, last.Op)
+
+	// повторный запуск ничего не меняет
+	n, err = store.ApplyDueSchedules(now)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+// TestTopAddresses проверяет рейтинг адресов по количеству посылок
+func TestTopAddresses(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	for _, address := range []string{"c", "a", "b", "a", "c", "a", "d"} {
+		parcel := getTestParcel()
+		parcel.Address = address
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	top, err := store.TopAddresses(3)
+	require.NoError(t, err)
+	assert.Equal(t, []AddressCount{
+		{Address: "a", Count: 3},
+		{Address: "c", Count: 2},
+		{Address: "b", Count: 1},
+	}, top)
+
+	_, err = store.TopAddresses(0)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+// TestFullView проверяет согласованность полного представления посылки
+func TestFullView(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.AddNote(id, "first"))
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+	require.NoError(t, store.AddNote(id, "second"))
+
+	// записи другой посылки не должны попасть в представление
+	otherID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.AddNote(otherID, "other"))
+
+	// view
+	view, err := store.FullView(id)
+	require.NoError(t, err)
+
+	// check
+	parcel, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, parcel, view.Parcel)
+
+	require.Len(t, view.History, 2)
+	assert.Equal(t, ChangeOpAdd, view.History[0].Op)
+	assert.Equal(t, ChangeOpSetStatus, view.History[1].Op)
+	for _, change := range view.History {
+		assert.Equal(t, id, change.Number)
+	}
+
+	require.Len(t, view.Notes, 2)
+	assert.Equal(t, "first", view.Notes[0].Note)
+	assert.Equal(t, "second", view.Notes[1].Note)
+	for _, note := range view.Notes {
+		assert.Equal(t, id, note.ParcelNumber)
+	}
+
+	// not found
+	_, err = store.FullView(otherID + 1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestNormalizeAllAddresses проверяет нормализацию сохранённых адресов
+func TestNormalizeAllAddresses(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	addresses := map[string]string{
+		"  Псков,   ул. Колотушкина ": "Псков, ул. Колотушкина",
+		"Саратов,\tд. 25":             "Саратов, д. 25",
+		"Москва, д. 1":                "Москва, д. 1",
+	}
+	ids := map[int]string{}
+	for address, normalized := range addresses {
+		parcel := getTestParcel()
+		parcel.Address = address
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+		ids[id] = normalized
+	}
+
+	changes, err := store.ChangesSince(0, 100)
+	require.NoError(t, err)
+	lastSeq := changes[len(changes)-1].Seq
+
+	// normalize
+	n, err := store.NormalizeAllAddresses()
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// check
+	for id, normalized := range ids {
+		parcel, err := store.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, normalized, parcel.Address)
+	}
+
+	// уже нормализованный адрес не перезаписывался
+	changes, err = store.ChangesSince(lastSeq, 100)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	for _, change := range changes {
+		assert.Equal(t, ChangeOpSetAddress, change.Op)
+		assert.NotEqual(t, "Москва, д. 1", ids[change.Number])
+	}
+}
+
+// TestPendingNotifications проверяет, что уведомление о посылке отправляется один раз
+func TestPendingNotifications(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	sentID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(sentID, ParcelStatusSent))
+
+	_, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	// pending
+	pending, err := store.GetPendingNotifications(ParcelStatusSent)
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, sentID, pending[0].Number)
+
+	// mark
+	n, err := store.MarkNotified([]int{sentID})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// check
+	pending, err = store.GetPendingNotifications(ParcelStatusSent)
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	n, err = store.MarkNotified([]int{sentID})
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+// TestWithSchema проверяет работу хранилища с таблицами в подключённой схеме
+func TestWithSchema(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+
+	// подключённая БД видна только в своём соединении, поэтому оставляем в пуле одно
+	db.SetMaxOpenConns(1)
+
+	_, err := db.Exec("ATTACH DATABASE ':memory:' AS archive")
+	require.NoError(t, err)
+
+	for _, query := range testSchema(t) {
+		query = strings.Replace(query, "CREATE TABLE ", "CREATE TABLE archive.", 1)
+		query = strings.Replace(query, "CREATE INDEX ", "CREATE INDEX archive.", 1)
+		_, err := db.Exec(query)
+		require.NoError(t, err)
+	}
+
+	store := NewParcelStore(db)
+	archive := store.WithSchema("archive")
+	parcel := getTestParcel()
+
+	// add
+	id, err := archive.Add(parcel)
+	require.NoError(t, err)
+	parcel.Number = id
+
+	// check
+	stored, err := archive.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, parcel, stored)
+
+	_, err = store.Get(id)
+	require.ErrorIs(t, err, sql.ErrNoRows)
+
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM archive.parcel_changelog").Scan(&count))
+	assert.Equal(t, 1, count)
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM main.parcel_changelog").Scan(&count))
+	assert.Equal(t, 0, count)
+
+	assert.Panics(t, func() { store.WithSchema("archive; DROP TABLE parcel") })
+}
+
+// TestWritePrometheus проверяет выгрузку метрик в формате Prometheus
+func TestWritePrometheus(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	// статус со спецсимволами и не-ASCII буквами, которые %q экранировал бы не по правилам Prometheus
+	_, err := db.Exec("INSERT INTO parcel (client, status, address, created_at) VALUES (1, :status, 'test', '2024-01-01T00:00:00Z')",
+		sql.Named("status", "утерян \"в пути\"\\\n"))
+	require.NoError(t, err)
+
+	for _, status := range []string{ParcelStatusRegistered, ParcelStatusSent, ParcelStatusSent} {
+		parcel := getTestParcel()
+		parcel.Status = status
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// write
+	var buf bytes.Buffer
+	err = store.WritePrometheus(&buf)
+	require.NoError(t, err)
+
+	// check
+	out := buf.String()
+	assert.Contains(t, out, "# TYPE parcels_total gauge\n")
+	assert.Contains(t, out, "\nparcels_total 4\n")
+	assert.Contains(t, out, "# TYPE parcels_by_status gauge\n")
+	assert.Contains(t, out, "\nparcels_by_status{status=\"registered\"} 1\n")
+	assert.Contains(t, out, "\nparcels_by_status{status=\"sent\"} 2\n")
+	assert.Contains(t, out, "\nparcels_by_status{status=\"delivered\"} 0\n")
+	assert.Contains(t, out, "\nparcels_by_status{status=\"утерян \\\"в пути\\\"\\\\\\n\"} 1\n")
+}
+
+// TestSaveEdit проверяет обнаружение одновременного редактирования посылки
+func TestSaveEdit(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	parcel, token, err := store.GetForEdit(id)
+	require.NoError(t, err)
+	require.NotEmpty(t, token)
+
+	// concurrent change
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+
+	parcel.Address = "edited"
+	err = store.SaveEdit(parcel, token)
+	require.ErrorIs(t, err, ErrVersionConflict)
+
+	// retry: адрес отправленной посылки менять нельзя
+	parcel, token, err = store.GetForEdit(id)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusSent, parcel.Status)
+
+	edited := parcel
+	edited.Address = "edited"
+	err = store.SaveEdit(edited, token)
+	require.ErrorIs(t, err, ErrAddressNotEditable)
+
+	// недопустимые статусы
+	edited = parcel
+	edited.Status = "lost"
+	err = store.SaveEdit(edited, token)
+	require.ErrorIs(t, err, ErrInvalidStatus)
+
+	edited.Status = ParcelStatusRegistered
+	err = store.SaveEdit(edited, token)
+	require.ErrorIs(t, err, ErrInvalidTransition)
+
+	// допустимый переход
+	edited.Status = ParcelStatusDelivered
+	err = store.SaveEdit(edited, token)
+	require.NoError(t, err)
+
+	// check
+	stored, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, edited, stored)
+
+	// адрес посылки в статусе registered меняется
+	other, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	parcel, token, err = store.GetForEdit(other)
+	require.NoError(t, err)
+
+	parcel.Address = "edited"
+	require.NoError(t, store.SaveEdit(parcel, token))
+
+	stored, err = store.Get(other)
+	require.NoError(t, err)
+	assert.Equal(t, "edited", stored.Address)
+
+	_, _, err = store.GetForEdit(other + 1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestIter проверяет итерацию по посылкам и закрытие выборки при досрочном выходе
+func TestIter(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	ids := make([]int, 5)
+	for i := range ids {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		ids[i] = id
+	}
+
+	// full
+	var all []int
+	for parcel, err := range store.Iter(context.Background()) {
+		require.NoError(t, err)
+		all = append(all, parcel.Number)
+	}
+	assert.Equal(t, ids, all)
+
+	// break
+	var first []int
+	for parcel, err := range store.Iter(context.Background()) {
+		require.NoError(t, err)
+		first = append(first, parcel.Number)
+		if len(first) == 2 {
+			// выборка ещё открыта и удерживает соединение
+			assert.Equal(t, 1, store.InUse())
+			break
+		}
+	}
+	assert.Equal(t, ids[:2], first)
+
+	// после выхода из цикла выборка закрыта и соединение возвращено в пул
+	assert.Equal(t, 0, store.InUse())
+}
+
+// TestCreationByHour проверяет распределение созданных посылок по часам суток
+func TestCreationByHour(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	for _, date := range []string{
+		"2024-01-08T09:00:00Z",
+		"2024-01-09T09:59:59Z",
+		"2024-01-10T23:30:00Z",
+	} {
+		parcel := getTestParcel()
+		parcel.CreatedAt = date
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// utc
+	byHour, err := store.CreationByHour()
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{9: 2, 23: 1}, byHour)
+
+	// location
+	byHour, err = store.CreationByHourIn(time.FixedZone("UTC+3", 3*60*60))
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{12: 2, 2: 1}, byHour)
+
+	// nil location
+	byHour, err = store.CreationByHourIn(nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[int]int{9: 2, 23: 1}, byHour)
+}
+
+// TestRemapStatuses проверяет замену устаревших статусов
+func TestRemapStatuses(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	expected := map[int]string{}
+	for _, status := range []string{"created", "shipped", "created", ParcelStatusDelivered} {
+		parcel := getTestParcel()
+		parcel.Status = status
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+		expected[id] = status
+	}
+
+	mapping := map[string]string{
+		"created": ParcelStatusRegistered,
+		"shipped": ParcelStatusSent,
+	}
+
+	// invalid
+	_, err := store.RemapStatuses(map[string]string{"created": "made"})
+	require.ErrorIs(t, err, ErrInvalidStatus)
+
+	// remap
+	n, err := store.RemapStatuses(mapping)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// check
+	for id, status := range expected {
+		if to, ok := mapping[status]; ok {
+			status = to
+		}
+
+		parcel, err := store.Get(id)
+		require.NoError(t, err)
+		assert.Equal(t, status, parcel.Status)
+	}
+}
+
+// TestSupportSnapshot проверяет, что снимок посылки для поддержки содержит все разделы
+func TestSupportSnapshot(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	parentID, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	ids, err := store.Split(parentID, 1)
+	require.NoError(t, err)
+	id := ids[0]
+
+	require.NoError(t, store.SetAddress(id, "new test address"))
+	require.NoError(t, store.AddNote(id, "клиент просил позвонить"))
+
+	// snapshot
+	data, err := store.SupportSnapshot(id)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "\n  \"parcel\": {")
+
+	// check
+	var snapshot struct {
+		Parcel   map[string]any   `json:"parcel"`
+		Metadata map[string]any   `json:"metadata"`
+		History  []map[string]any `json:"history"`
+		Notes    []map[string]any `json:"notes"`
+	}
+	require.NoError(t, json.Unmarshal(data, &snapshot))
+
+	parcel, err := store.Get(id)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"number":     float64(parcel.Number),
+		"client":     float64(parcel.Client),
+		"status":     parcel.Status,
+		"address":    parcel.Address,
+		"created_at": parcel.CreatedAt,
+	}, snapshot.Parcel)
+
+	assert.Equal(t, true, snapshot.Metadata["address_changed"])
+	assert.Equal(t, float64(parentID), snapshot.Metadata["parent_number"])
+	assert.Contains(t, snapshot.Metadata, "notified_at")
+
+	require.Len(t, snapshot.History, 2)
+	assert.Equal(t, ChangeOpAdd, snapshot.History[0]["op"])
+	assert.Equal(t, ChangeOpSetAddress, snapshot.History[1]["op"])
+	assert.Contains(t, snapshot.History[0], "seq")
+	assert.Contains(t, snapshot.History[0], "at")
+
+	require.Len(t, snapshot.Notes, 1)
+	assert.Equal(t, "клиент просил позвонить", snapshot.Notes[0]["note"])
+	assert.Contains(t, snapshot.Notes[0], "at")
+
+	// not found
+	_, err = store.SupportSnapshot(id + 1)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestClientReadLimit проверяет ограничение частоты чтения посылок клиента
+func TestClientReadLimit(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	limited, other := 1, 2
+
+	// за время теста новые токены практически не появляются
+	store.SetClientReadLimit(0.001, 3)
+
+	// rapid reads
+	allowed, rejected := 0, 0
+	for i := 0; i < 10; i++ {
+		_, err := store.GetByClient(limited)
+		if errors.Is(err, ErrRateLimited) {
+			rejected++
+			continue
+		}
+		require.NoError(t, err)
+		allowed++
+	}
+	assert.Equal(t, 3, allowed)
+	assert.Equal(t, 7, rejected)
+
+	// ограничение общее для всех чтений клиента
+	_, _, err := store.PlanBulkSetStatus(limited, ParcelStatusSent)
+	require.ErrorIs(t, err, ErrRateLimited)
+
+	// другой клиент не затронут
+	_, err = store.GetByClient(other)
+	require.NoError(t, err)
+
+	// disable
+	store.SetClientReadLimit(0, 0)
+
+	_, err = store.GetByClient(limited)
+	require.NoError(t, err)
+}
+
+// TestRepairSequence проверяет восстановление счётчика номеров посылок
+func TestRepairSequence(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	_, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	parcel := getTestParcel()
+	parcel.Number = 1000
+	_, err = store.ImportSlice([]Parcel{parcel}, ConflictError)
+	require.NoError(t, err)
+
+	// corrupt
+	_, err = db.Exec("UPDATE sqlite_sequence SET seq = 5 WHERE name = 'parcel'")
+	require.NoError(t, err)
+
+	// repair
+	seq, err := store.RepairSequence()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, seq)
+
+	var stored int
+	require.NoError(t, db.QueryRow("SELECT seq FROM sqlite_sequence WHERE name = 'parcel'").Scan(&stored))
+	assert.Equal(t, 1000, stored)
+
+	// повторный вызов ничего не меняет
+	seq, err = store.RepairSequence()
+	require.NoError(t, err)
+	assert.Equal(t, 1000, seq)
+
+	// check
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	assert.Equal(t, 1001, id)
+}
+
+// TestSameAddress проверяет поиск посылок с тем же адресом
+func TestSameAddress(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	add := func(address string) int {
+		parcel := getTestParcel()
+		parcel.Address = address
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+		return id
+	}
+	source := add("Псков, ул. Колотушкина, д. 5")
+	same := add("Псков, ул. Колотушкина, д. 5")
+	messy := add("  Псков,  ул. Колотушкина, д. 5")
+	add("Саратов, д. 25")
+
+	// get
+	parcels, err := store.SameAddress(source)
+	require.NoError(t, err)
+
+	// check
+	var numbers []int
+	for _, parcel := range parcels {
+		numbers = append(numbers, parcel.Number)
+	}
+	assert.Equal(t, []int{same, messy}, numbers)
+
+	_, err = store.SameAddress(source + 100)
+	require.ErrorIs(t, err, ErrParcelNotFound)
+}
+
+// TestPlanBulkSetStatus проверяет предварительный разбор массовой смены статуса
+func TestPlanBulkSetStatus(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	add := func(status string) int {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		if status != ParcelStatusRegistered {
+			require.NoError(t, store.SetStatus(id, status))
+		}
+		return id
+	}
+	registered := add(ParcelStatusRegistered)
+	sent := add(ParcelStatusSent)
+	delivered := add(ParcelStatusDelivered)
+
+	other := getTestParcel()
+	other.Client++
+	_, err := store.Add(other)
+	require.NoError(t, err)
+
+	// plan
+	eligible, rejected, err := store.PlanBulkSetStatus(getTestParcel().Client, ParcelStatusDelivered)
+	require.NoError(t, err)
+
+	// check
+	assert.Equal(t, []int{sent}, eligible)
+	require.Len(t, rejected, 2)
+	assert.Contains(t, rejected, registered)
+	assert.Contains(t, rejected, delivered)
+
+	// статусы не изменились
+	p, err := store.Get(sent)
+	require.NoError(t, err)
+	assert.Equal(t, ParcelStatusSent, p.Status)
+
+	_, _, err = store.PlanBulkSetStatus(getTestParcel().Client, "lost")
+	require.ErrorIs(t, err, ErrInvalidStatus)
+}
+
+// TestEstimatedStorageBytes проверяет, что оценка занимаемого места растёт с добавлением посылок
+func TestEstimatedStorageBytes(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	before, err := store.EstimatedStorageBytes()
+	require.NoError(t, err)
+
+	// add
+	parcel := getTestParcel()
+	parcel.Address = strings.Repeat("Псков, ул. Колотушкина, д. 5; ", 10)
+	for i := 0; i < 200; i++ {
+		_, err := store.Add(parcel)
+		require.NoError(t, err)
+	}
+
+	// check
+	after, err := store.EstimatedStorageBytes()
+	require.NoError(t, err)
+	assert.Greater(t, after, before)
+}
+
+// TestApplyAddressCorrections проверяет пакетное исправление адресов
+func TestApplyAddressCorrections(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	first, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	second, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(second, ParcelStatusSent))
+
+	// apply
+	applied, notFound, err := store.ApplyAddressCorrections(map[int]string{
+		first:        "  Псков,  ул. Колотушкина, д. 5 ",
+		second:       "Саратов, д. 25",
+		second + 100: "Тула",
+		second + 50:  "Тверь",
+	})
+	require.NoError(t, err)
+
+	// check
+	assert.Equal(t, 2, applied)
+	assert.Equal(t, []int{second + 50, second + 100}, notFound)
+
+	p, err := store.Get(first)
+	require.NoError(t, err)
+	assert.Equal(t, "Псков, ул. Колотушкина, д. 5", p.Address)
+
+	p, err = store.Get(second)
+	require.NoError(t, err)
+	assert.Equal(t, "Саратов, д. 25", p.Address)
+
+	// пустой адрес отменяет все исправления
+	_, _, err = store.ApplyAddressCorrections(map[int]string{first: "Тула", second: "   "})
+	require.ErrorIs(t, err, ErrInvalidParcel)
+
+	p, err = store.Get(first)
+	require.NoError(t, err)
+	assert.Equal(t, "Псков, ул. Колотушкина, д. 5", p.Address)
+}
+
+// TestCountSince проверяет подсчёт посылок, добавленных после контрольной точки
+func TestCountSince(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	var checkpoint int
+	for i := 0; i < 3; i++ {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		checkpoint = id
+	}
+
+	count, err := store.CountSince(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// add
+	for i := 0; i < 2; i++ {
+		_, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+	}
+
+	// check
+	count, err = store.CountSince(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = store.CountSince(0)
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+}
+
+// TestAverageStatusChanges проверяет среднее количество смен статуса на посылку
+func TestAverageStatusChanges(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	avg, err := store.AverageStatusChanges()
+	require.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+
+	first, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	second, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	// посылка без смен статуса не учитывается
+	third, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	require.NoError(t, store.SetStatus(first, ParcelStatusSent))
+	require.NoError(t, store.SetStatus(first, ParcelStatusDelivered))
+	require.NoError(t, store.SetStatus(second, ParcelStatusSent))
+	// повторная установка того же статуса не является сменой статуса
+	require.NoError(t, store.SetStatus(second, ParcelStatusSent))
+	// смена адреса не является сменой статуса
+	require.NoError(t, store.SetAddress(third, "Саратов, д. 25"))
+
+	// check
+	avg, err = store.AverageStatusChanges()
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, avg)
+
+	// смена статуса при редактировании учитывается
+	parcel, token, err := store.GetForEdit(second)
+	require.NoError(t, err)
+	parcel.Status = ParcelStatusDelivered
+	require.NoError(t, store.SaveEdit(parcel, token))
+
+	avg, err = store.AverageStatusChanges()
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, avg)
+}
+
+// TestSingleShipmentClients проверяет выбор клиентов с единственной посылкой
+func TestSingleShipmentClients(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	counts := map[int]int{1001: 1, 1002: 3, 1003: 1, 1004: 2}
+	for client, n := range counts {
+		for i := 0; i < n; i++ {
+			parcel := getTestParcel()
+			parcel.Client = client
+			_, err := store.Add(parcel)
+			require.NoError(t, err)
+		}
+	}
+
+	// get
+	clients, err := store.SingleShipmentClients()
+	require.NoError(t, err)
+
+	// check
+	assert.Equal(t, []int{1001, 1003}, clients)
+}
+
+// TestDeliverAllSent проверяет доставку всех отправленных посылок клиента
+func TestDeliverAllSent(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	add := func(client int, status string) int {
+		parcel := getTestParcel()
+		parcel.Client = client
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+		if status != ParcelStatusRegistered {
+			require.NoError(t, store.SetStatus(id, status))
+		}
+		return id
+	}
+	registered := add(1000, ParcelStatusRegistered)
+	sent1 := add(1000, ParcelStatusSent)
+	sent2 := add(1000, ParcelStatusSent)
+	otherClient := add(1001, ParcelStatusSent)
+
+	// deliver
+	n, err := store.DeliverAllSent(1000)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// check
+	want := map[int]string{
+		registered:  ParcelStatusRegistered,
+		sent1:       ParcelStatusDelivered,
+		sent2:       ParcelStatusDelivered,
+		otherClient: ParcelStatusSent,
+	}
+	for number, status := range want {
+		p, err := store.Get(number)
+		require.NoError(t, err)
+		assert.Equal(t, status, p.Status, "parcel %d", number)
+
+		var deliveredAt sql.NullString
+		err = db.QueryRow("SELECT delivered_at FROM parcel WHERE number = :number", sql.Named("number", number)).Scan(&deliveredAt)
+		require.NoError(t, err)
+		assert.Equal(t, status == ParcelStatusDelivered, deliveredAt.Valid, "parcel %d", number)
+	}
+
+	changes, err := store.ChangesSince(0, 100)
+	require.NoError(t, err)
+	last := changes[len(changes)-1]
+	assert.Equal(t, sent2, last.Number)
+	assert.Equal(t, ChangeOpSetStatus, last.Op)
+}
+
+// TestDeliveredAt проверяет, что все способы смены статуса проставляют и сбрасывают delivered_at
+func TestDeliveredAt(t *testing.T) {
+	// prepare
+	db := newTestDB(t)
+	store := NewParcelStore(db)
+
+	deliveredAt := func(number int) bool {
+		var at sql.NullString
+		err := db.QueryRow("SELECT delivered_at FROM parcel WHERE number = :number", sql.Named("number", number)).Scan(&at)
+		require.NoError(t, err)
+		return at.Valid
+	}
+	addSent := func() int {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+		return id
+	}
+
+	// SetStatus
+	bySetStatus := addSent()
+	require.NoError(t, store.SetStatus(bySetStatus, ParcelStatusDelivered))
+	assert.True(t, deliveredAt(bySetStatus))
+
+	// SaveEdit
+	bySaveEdit := addSent()
+	parcel, token, err := store.GetForEdit(bySaveEdit)
+	require.NoError(t, err)
+	parcel.Status = ParcelStatusDelivered
+	require.NoError(t, store.SaveEdit(parcel, token))
+	assert.True(t, deliveredAt(bySaveEdit))
+
+	// ApplyDueSchedules
+	bySchedule := addSent()
+	require.NoError(t, store.ScheduleStatus(bySchedule, ParcelStatusDelivered, time.Now().Add(-time.Hour)))
+	_, err = store.ApplyDueSchedules(time.Now())
+	require.NoError(t, err)
+	assert.True(t, deliveredAt(bySchedule))
+
+	// AutoAdvance
+	old := getTestParcel()
+	old.CreatedAt = time.Now().UTC().Add(-48 * time.Hour).Format(time.RFC3339)
+	byAutoAdvance, err := store.Add(old)
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(byAutoAdvance, ParcelStatusSent))
+	_, err = store.AutoAdvance(ParcelStatusSent, ParcelStatusDelivered, 24*time.Hour)
+	require.NoError(t, err)
+	assert.True(t, deliveredAt(byAutoAdvance))
+
+	// уход из delivered сбрасывает время доставки
+	_, err = store.RemapStatuses(map[string]string{ParcelStatusDelivered: ParcelStatusSent})
+	require.NoError(t, err)
+	for _, number := range []int{bySetStatus, bySaveEdit, bySchedule, byAutoAdvance} {
+		assert.False(t, deliveredAt(number), "parcel %d", number)
+	}
+}
+
+// TestUndispatchedEvents проверяет выборку и отметку событий для вебхуков
+func TestUndispatchedEvents(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+	require.NoError(t, store.SetStatus(id, ParcelStatusDelivered))
+
+	// get
+	events, err := store.UndispatchedEvents(10)
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+	assert.Equal(t, ChangeOpAdd, events[0].Op)
+	assert.Equal(t, ChangeOpSetStatus, events[2].Op)
+	for _, e := range events {
+		assert.Equal(t, id, e.Number)
+	}
+
+	// mark
+	n, err := store.MarkDispatched([]int{events[0].ID, events[1].ID})
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// check
+	rest, err := store.UndispatchedEvents(10)
+	require.NoError(t, err)
+	require.Len(t, rest, 1)
+	assert.Equal(t, events[2], rest[0])
+
+	n, err = store.MarkDispatched([]int{events[0].ID, events[2].ID})
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	rest, err = store.UndispatchedEvents(10)
+	require.NoError(t, err)
+	assert.Empty(t, rest)
+
+	_, err = store.UndispatchedEvents(0)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+// TestDiffSnapshots проверяет разницу между снимками количества посылок
+func TestDiffSnapshots(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	before, err := store.SnapshotCounts()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{ParcelStatusRegistered: 1}, before.Counts)
+
+	// change
+	require.NoError(t, store.SetStatus(id, ParcelStatusSent))
+	for i := 0; i < 2; i++ {
+		_, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+	}
+
+	after, err := store.SnapshotCounts()
+	require.NoError(t, err)
+	assert.False(t, after.At.Before(before.At))
+
+	// check
+	diff := DiffSnapshots(before, after)
+	assert.Equal(t, map[string]int{ParcelStatusRegistered: 1, ParcelStatusSent: 1}, diff)
+}
+
+// TestUniqueAddressPerClient проверяет запрет повторного адреса у клиента
+func TestUniqueAddressPerClient(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	// без опции повторный адрес разрешён
+	_, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	_, err = store.Add(getTestParcel())
+	require.NoError(t, err)
+
+	store.SetUniqueAddressPerClient(true)
+
+	// add
+	parcel := getTestParcel()
+	parcel.Address = "Псков, ул. Колотушкина, д. 5"
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+
+	_, err = store.Add(parcel)
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	// другой адрес того же клиента
+	parcel.Address = "Саратов, д. 25"
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+
+	// тот же адрес у другого клиента
+	parcel.Client++
+	_, err = store.Add(parcel)
+	require.NoError(t, err)
+
+	// check
+	parcels, err := store.GetByClient(getTestParcel().Client)
+	require.NoError(t, err)
+	assert.Len(t, parcels, 4)
+}
+
+// TestUniqueAddressPerClientBulk проверяет запрет повторного адреса в остальных способах добавления посылок
+func TestUniqueAddressPerClientBulk(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	store.SetUniqueAddressPerClient(true)
+
+	parcel := getTestParcel()
+	id, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	// quota
+	_, err = store.AddIfUnderQuota(parcel, 10)
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	_, err = store.AddIfUnderQuota(parcel, 1)
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	other := parcel
+	other.Address = "Саратов, д. 25"
+	_, err = store.AddIfUnderQuota(other, 1)
+	require.ErrorIs(t, err, ErrClientLimitExceeded)
+
+	// batch
+	_, err = store.AddPartialBatch([]struct {
+		Client  int
+		Address string
+	}{{Client: parcel.Client, Address: "Тула"}, {Client: parcel.Client, Address: parcel.Address}})
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	// import
+	_, err = store.ImportSlice([]Parcel{parcel}, ConflictError)
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	replaced := parcel
+	replaced.Number = id
+	replaced.Status = ParcelStatusSent
+	res, err := store.ImportSlice([]Parcel{replaced}, ConflictReplace)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Replaced)
+
+	// split
+	_, err = store.Split(id, 1)
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	// check
+	parcels, err := store.GetByClient(parcel.Client)
+	require.NoError(t, err)
+	require.Len(t, parcels, 1)
+	assert.Equal(t, replaced, parcels[0])
+}
+
+// TestUniqueAddressPerClientUpdates проверяет уникальность адресов при смене адреса и клиента
+func TestUniqueAddressPerClientUpdates(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+	store.SetUniqueAddressPerClient(true)
+
+	parcel := getTestParcel()
+	first, err := store.Add(parcel)
+	require.NoError(t, err)
+
+	other := parcel
+	other.Address = "Саратов,  д. 25"
+	second, err := store.Add(other)
+	require.NoError(t, err)
+
+	otherClient := parcel
+	otherClient.Client = parcel.Client + 1
+	_, err = store.Add(otherClient)
+	require.NoError(t, err)
+
+	// set address
+	require.ErrorIs(t, store.SetAddress(second, parcel.Address), ErrDuplicateAddress)
+	require.NoError(t, store.SetAddress(first, parcel.Address))
+
+	// corrections
+	_, _, err = store.ApplyAddressCorrections(map[int]string{second: parcel.Address})
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	// edit
+	edited, token, err := store.GetForEdit(first)
+	require.NoError(t, err)
+	edited.Client = otherClient.Client
+	require.ErrorIs(t, store.SaveEdit(edited, token), ErrDuplicateAddress)
+
+	// normalize
+	require.NoError(t, store.SetAddress(first, "Саратов, д. 25"))
+	_, err = store.NormalizeAllAddresses()
+	require.ErrorIs(t, err, ErrDuplicateAddress)
+
+	// check
+	stored, err := store.Get(second)
+	require.NoError(t, err)
+	assert.Equal(t, other.Address, stored.Address)
+
+	stored, err = store.Get(first)
+	require.NoError(t, err)
+	assert.Equal(t, parcel.Client, stored.Client)
+	assert.Equal(t, "Саратов, д. 25", stored.Address)
+}
+
+// TestRoutesByPrefix проверяет группировку недоставленных посылок по префиксу адреса
+func TestRoutesByPrefix(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	add := func(address, status string) int {
+		parcel := getTestParcel()
+		parcel.Address = address
+		id, err := store.Add(parcel)
+		require.NoError(t, err)
+		if status != ParcelStatusRegistered {
+			require.NoError(t, store.SetStatus(id, status))
+		}
+		return id
+	}
+	a1 := add("180000 Псков, ул. Колотушкина, д. 5", ParcelStatusRegistered)
+	a2 := add("  180000   Псков, д. 7", ParcelStatusSent)
+	b1 := add("410000 Саратов, д. 25", ParcelStatusRegistered)
+	add("180000 Псков, д. 9", ParcelStatusDelivered)
+	short := add("Тула", ParcelStatusRegistered)
+
+	// get
+	routes, err := store.RoutesByPrefix(6)
+	require.NoError(t, err)
+
+	// check
+	numbers := func(parcels []Parcel) []int {
+		var res []int
+		for _, p := range parcels {
+			res = append(res, p.Number)
+		}
+		return res
+	}
+	require.Len(t, routes, 3)
+	assert.Equal(t, []int{a1, a2}, numbers(routes["180000"]))
+	assert.Equal(t, []int{b1}, numbers(routes["410000"]))
+	assert.Equal(t, []int{short}, numbers(routes["Тула"]))
+
+	_, err = store.RoutesByPrefix(0)
+	require.ErrorIs(t, err, ErrInvalidPrefixLength)
+}
+
+// TestReindex проверяет возобновляемую переиндексацию после сбоя push
+func TestReindex(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	var all []int
+	for i := 0; i < 7; i++ {
+		id, err := store.Add(getTestParcel())
+		require.NoError(t, err)
+		all = append(all, id)
+	}
+
+	var pushed []int
+	errPush := errors.New("index unavailable")
+	calls := 0
+	push := func(parcels []Parcel) error {
+		calls++
+		// вторая пачка не принимается
+		if calls == 2 {
+			return errPush
+		}
+		for _, p := range parcels {
+			pushed = append(pushed, p.Number)
+		}
+		return nil
+	}
+
+	// reindex
+	last, err := store.Reindex(context.Background(), 0, 3, push)
+	require.ErrorIs(t, err, errPush)
+	assert.Equal(t, all[2], last)
+	assert.Equal(t, all[:3], pushed)
+
+	// resume
+	last, err = store.Reindex(context.Background(), last, 3, push)
+	require.NoError(t, err)
+
+	// check
+	assert.Equal(t, all[6], last)
+	assert.Equal(t, all, pushed)
+
+	_, err = store.Reindex(context.Background(), 0, 0, push)
+	require.ErrorIs(t, err, ErrInvalidLimit)
+}
+
+// TestBulkWritersLogChanges проверяет, что пакетные изменения записываются в журнал изменений
+func TestBulkWritersLogChanges(t *testing.T) {
+	// prepare
+	store := NewParcelStore(newTestDB(t))
+
+	ops := func() map[int][]string {
+		changes, err := store.ChangesSince(0, 1000)
+		require.NoError(t, err)
+
+		res := map[int][]string{}
+		for _, c := range changes {
+			res[c.Number] = append(res[c.Number], c.Op)
+		}
+		return res
+	}
+
+	old := getTestParcel()
+	old.CreatedAt = time.Now().UTC().Add(-48 * time.Hour).Format(time.RFC3339)
+	future := getTestParcel()
+	future.CreatedAt = time.Now().UTC().Add(48 * time.Hour).Format(time.RFC3339)
+	_, err := store.ImportSlice([]Parcel{old, future}, ConflictError)
+	require.NoError(t, err)
+	changes, err := store.ChangesSince(0, 10)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	oldID, futureID := changes[0].Number, changes[1].Number
+
+	replaced := old
+	replaced.Number = oldID
+	_, err = store.ImportSlice([]Parcel{replaced}, ConflictReplace)
+	require.NoError(t, err)
+
+	batch, err := store.AddPartialBatch([]struct {
+		Client  int
+		Address string
+	}{{Client: 1000, Address: "test"}})
+	require.NoError(t, err)
+
+	quota, err := store.AddIfUnderQuota(getTestParcel(), 10)
+	require.NoError(t, err)
+
+	children, err := store.Split(quota, 1)
+	require.NoError(t, err)
+
+	n, err := store.AutoAdvance(ParcelStatusRegistered, ParcelStatusSent, 24*time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	n, err = store.ClampFutureDates()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// check
+	got := ops()
+	assert.Equal(t, []string{ChangeOpAdd, ChangeOpEdit, ChangeOpSetStatus}, got[oldID])
+	assert.Equal(t, []string{ChangeOpAdd, ChangeOpEdit}, got[futureID])
+	assert.Equal(t, []string{ChangeOpAdd}, got[batch[0]])
+	assert.Equal(t, []string{ChangeOpAdd}, got[quota])
+	assert.Equal(t, []string{ChangeOpAdd}, got[children[0]])
+
+	avg, err := store.AverageStatusChanges()
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, avg)
+}
+
+// TestEnsureSchema проверяет миграцию БД с исходной схемой и совпадение схемы с tracker.db
+func TestEnsureSchema(t *testing.T) {
+	// prepare
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "old.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	// первая версия таблицы parcel с одной посылкой
+	_, err = db.Exec(`CREATE TABLE parcel
+(
+    number     integer
+        constraint parcel_pk
+            primary key autoincrement,
+    client     integer      not null,
+    status     VARCHAR(128) not null,
+    address    VARCHAR(512) not null,
+    created_at text         not null
+)`)
+	require.NoError(t, err)
+	parcel := getTestParcel()
+	_, err = db.Exec("INSERT INTO parcel (client, status, address, created_at) VALUES (:client, :status, :address, :created_at)",
+		sql.Named("client", parcel.Client),
+		sql.Named("status", parcel.Status),
+		sql.Named("address", parcel.Address),
+		sql.Named("created_at", parcel.CreatedAt))
+	require.NoError(t, err)
+
+	// migrate
+	require.NoError(t, EnsureSchema(db))
+	require.NoError(t, EnsureSchema(db))
+
+	// check
+	store := NewParcelStore(db)
+	old, err := store.Get(1)
+	require.NoError(t, err)
+	parcel.Number = 1
+	assert.Equal(t, parcel, old)
+
+	id, err := store.Add(getTestParcel())
+	require.NoError(t, err)
+	require.NoError(t, store.SetAddress(id, "new test address"))
+
+	// схема после миграции совпадает со схемой tracker.db
+	columns := func(db *sql.DB) map[string][]string {
+		rows, err := db.Query(`SELECT m.name, c.name FROM sqlite_master AS m, pragma_table_info(m.name) AS c
+			WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%' ORDER BY m.name, c.cid`)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		res := map[string][]string{}
+		for rows.Next() {
+			var table, column string
+			require.NoError(t, rows.Scan(&table, &column))
+			res[table] = append(res[table], column)
+		}
+		require.NoError(t, rows.Err())
+		return res
+	}
+
+	fixture, err := sql.Open("sqlite", "tracker.db")
+	require.NoError(t, err)
+	defer fixture.Close()
+
+	assert.Equal(t, columns(fixture), columns(db))
 }